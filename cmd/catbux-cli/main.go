@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/warmans/catbux/pkg/blocks"
+	"github.com/warmans/catbux/pkg/client"
+	"github.com/warmans/catbux/pkg/wallet"
+)
+
+const (
+	DefaultNodeAddr = "localhost:8686"
+)
+
+var (
+	nodeAddr     = flag.String("node", DefaultNodeAddr, "HTTP address of the node to talk to")
+	keyPath      = flag.String("key", wallet.DefaultKeyPath, "path to the wallet's ECDSA private key")
+	lockTime     = flag.Int64("lock-time", 0, "block height (or unix time) before which sent transactions cannot be mined")
+	hdPassphrase = flag.String("passphrase", "", "optional passphrase used with the mnemonic of an HD wallet")
+	gapLimit     = flag.Int("gap-limit", wallet.DefaultGapLimit, "number of unused HD wallet keys in a row after which scanning stops")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s [flags] <command> [args]
+
+Commands:
+  keygen                 create a new wallet key at the key path
+  address                print the wallet address
+  pubkey                 print the wallet public key (to name the wallet in a multisig account)
+  balance                print the wallet balance
+  send <addr> <amount> [fee]
+                         pay amount to addr or a lock (and fee to the miner)
+  proof <txn-id>         print a proof that the txn is on the node's chain
+  multisig address <m> <pubkey>...
+                         print the lock (to pay to) and address of an m of n account
+  multisig balance <lock>
+                         print the balance of a multisig account
+  multisig create <file> <lock> <addr> <amount> [fee]
+                         write an unsigned txn paying from the account to file
+  multisig sign <file>   add the wallet's signature to the txn in file
+  multisig combine <file> <other-file>...
+                         add the signatures in the other files to file
+  multisig submit <file> send the txn in file to the node once it is fully signed
+  hd new                 print a new mnemonic to back up an HD wallet
+  hd scan                read a mnemonic from stdin and print the used keys and their balances
+  hd restore <n>         read a mnemonic from stdin and save its nth key at the key path
+  blocks                 print the node's chain
+  peers                  print the node's cluster members
+  mine                   ask the node to mine a block
+  mine start|stop|status control the node's background mining
+
+Flags:
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	node := client.New(*nodeAddr)
+
+	var err error
+	switch cmd := flag.Arg(0); cmd {
+	case "keygen":
+		err = keygen()
+	case "address":
+		err = address()
+	case "pubkey":
+		err = pubKey()
+	case "balance":
+		err = balance(node)
+	case "send":
+		if flag.NArg() != 3 && flag.NArg() != 4 {
+			usage()
+			os.Exit(2)
+		}
+		err = send(node, flag.Arg(1), flag.Arg(2), flag.Arg(3))
+	case "proof":
+		if flag.NArg() != 2 {
+			usage()
+			os.Exit(2)
+		}
+		err = printJSON(node.TransactionProof(flag.Arg(1)))
+	case "multisig":
+		if flag.NArg() < 2 {
+			usage()
+			os.Exit(2)
+		}
+		err = multisig(node, flag.Arg(1), flag.Args()[2:])
+	case "hd":
+		if flag.NArg() < 2 {
+			usage()
+			os.Exit(2)
+		}
+		err = hd(node, flag.Arg(1), flag.Args()[2:])
+	case "blocks":
+		err = printJSON(node.Blocks())
+	case "peers":
+		err = printJSON(node.Peers())
+	case "mine":
+		err = mine(node)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command: %s\n", cmd)
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+func keygen() error {
+	w, err := wallet.Generate()
+	if err != nil {
+		return err
+	}
+	if err := w.Save(*keyPath); err != nil {
+		return err
+	}
+	fmt.Println(w.Address())
+	return nil
+}
+
+func address() error {
+	w, err := wallet.Load(*keyPath)
+	if err != nil {
+		return err
+	}
+	fmt.Println(w.Address())
+	return nil
+}
+
+func pubKey() error {
+	w, err := wallet.Load(*keyPath)
+	if err != nil {
+		return err
+	}
+	fmt.Println(w.PubKey())
+	return nil
+}
+
+// walletUnspent fetches the unspent txn outs paid to any of the wallet's addresses.
+func walletUnspent(node *client.Client, w *wallet.Wallet) (*blocks.TxnOutUnspentSet, error) {
+	unspent := blocks.NewTxnOutUnspentSet()
+	for _, address := range w.Addresses() {
+		found, err := node.Unspent(address)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range found.All() {
+			unspent.Add(u)
+		}
+	}
+	return unspent, nil
+}
+
+func balance(node *client.Client) error {
+	w, err := wallet.Load(*keyPath)
+	if err != nil {
+		return err
+	}
+	unspent, err := walletUnspent(node, w)
+	if err != nil {
+		return err
+	}
+	fmt.Println(w.Balance(unspent))
+	return nil
+}
+
+func send(node *client.Client, to string, amountStr string, feeStr string) error {
+	amount, err := strconv.ParseInt(amountStr, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid amount: %s", amountStr)
+	}
+	fee := int64(0)
+	if feeStr != "" {
+		if fee, err = strconv.ParseInt(feeStr, 10, 64); err != nil {
+			return fmt.Errorf("invalid fee: %s", feeStr)
+		}
+	}
+	w, err := wallet.Load(*keyPath)
+	if err != nil {
+		return err
+	}
+	unspent, err := walletUnspent(node, w)
+	if err != nil {
+		return err
+	}
+	pending, err := node.PendingTransactions()
+	if err != nil {
+		return err
+	}
+	txn, err := w.CreateTransaction(to, amount, fee, *lockTime, unspent, pending)
+	if err != nil {
+		return err
+	}
+	if err := node.SubmitTransaction(txn); err != nil {
+		return err
+	}
+	fmt.Println(txn.ID)
+	return nil
+}
+
+func multisig(node *client.Client, cmd string, args []string) error {
+	switch {
+	case cmd == "address" && len(args) >= 2:
+		m, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid number of signatures: %s", args[0])
+		}
+		lock, err := wallet.MultiSigLock(m, args[1:]...)
+		if err != nil {
+			return err
+		}
+		fmt.Println(lock.String())
+		fmt.Println(blocks.LockAddress(lock))
+		return nil
+	case cmd == "balance" && len(args) == 1:
+		lock, err := blocks.ParseLock(args[0])
+		if err != nil {
+			return err
+		}
+		unspent, err := node.Unspent(blocks.LockAddress(lock))
+		if err != nil {
+			return err
+		}
+		total := int64(0)
+		for _, u := range unspent.All() {
+			total += u.Amount
+		}
+		fmt.Println(total)
+		return nil
+	case cmd == "create" && (len(args) == 4 || len(args) == 5):
+		return multisigCreate(node, args)
+	case cmd == "sign" && len(args) == 1:
+		w, err := wallet.Load(*keyPath)
+		if err != nil {
+			return err
+		}
+		p, err := wallet.LoadPartialTransaction(args[0])
+		if err != nil {
+			return err
+		}
+		signed, err := w.SignPartialTransaction(p)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("added %d signatures\n", signed)
+		return p.Save(args[0])
+	case cmd == "combine" && len(args) >= 2:
+		parts := []*wallet.PartialTransaction{}
+		for _, filePath := range args {
+			p, err := wallet.LoadPartialTransaction(filePath)
+			if err != nil {
+				return err
+			}
+			parts = append(parts, p)
+		}
+		combined, err := wallet.CombinePartialTransactions(parts...)
+		if err != nil {
+			return err
+		}
+		return combined.Save(args[0])
+	case cmd == "submit" && len(args) == 1:
+		p, err := wallet.LoadPartialTransaction(args[0])
+		if err != nil {
+			return err
+		}
+		txn, err := p.Complete()
+		if err != nil {
+			return err
+		}
+		if err := node.SubmitTransaction(txn); err != nil {
+			return err
+		}
+		fmt.Println(txn.ID)
+		return nil
+	default:
+		return fmt.Errorf("unknown multisig command or wrong number of arguments: %s", cmd)
+	}
+}
+
+func multisigCreate(node *client.Client, args []string) error {
+	lock, err := blocks.ParseLock(args[1])
+	if err != nil {
+		return err
+	}
+	amount, err := strconv.ParseInt(args[3], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid amount: %s", args[3])
+	}
+	fee := int64(0)
+	if len(args) == 5 {
+		if fee, err = strconv.ParseInt(args[4], 10, 64); err != nil {
+			return fmt.Errorf("invalid fee: %s", args[4])
+		}
+	}
+	unspent, err := node.Unspent(blocks.LockAddress(lock))
+	if err != nil {
+		return err
+	}
+	pending, err := node.PendingTransactions()
+	if err != nil {
+		return err
+	}
+	p, err := wallet.CreatePartialTransaction(lock, args[2], amount, fee, *lockTime, unspent, pending)
+	if err != nil {
+		return err
+	}
+	if err := p.Save(args[0]); err != nil {
+		return err
+	}
+	fmt.Println(p.Transaction.ID)
+	return nil
+}
+
+func hd(node *client.Client, cmd string, args []string) error {
+	switch {
+	case cmd == "new" && len(args) == 0:
+		mnemonic, err := wallet.NewMnemonic()
+		if err != nil {
+			return err
+		}
+		fmt.Println(mnemonic)
+		return nil
+	case cmd == "scan" && len(args) == 0:
+		return hdScan(node)
+	case cmd == "restore" && len(args) == 1:
+		n, err := strconv.ParseUint(args[0], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid key index: %s", args[0])
+		}
+		h, err := readHDWallet()
+		if err != nil {
+			return err
+		}
+		w, err := h.Wallet(uint32(n))
+		if err != nil {
+			return err
+		}
+		if err := w.Save(*keyPath); err != nil {
+			return err
+		}
+		fmt.Println(w.Address())
+		return nil
+	default:
+		return fmt.Errorf("unknown hd command or wrong number of arguments: %s", cmd)
+	}
+}
+
+func hdScan(node *client.Client) error {
+	h, err := readHDWallet()
+	if err != nil {
+		return err
+	}
+	raw, err := node.Blocks()
+	if err != nil {
+		return err
+	}
+	chain := struct {
+		Blocks []*blocks.Block `json:"blocks"`
+	}{}
+	if err := json.Unmarshal(raw, &chain); err != nil {
+		return errors.Wrap(err, "failed to decode blocks")
+	}
+	paid := map[string]struct{}{}
+	for _, b := range chain.Blocks {
+		for _, txn := range b.Data {
+			for _, out := range txn.TxnOut {
+				paid[out.Address] = struct{}{}
+			}
+		}
+	}
+
+	used, next, err := h.Scan(*gapLimit, func(w *wallet.Wallet) (bool, error) {
+		for _, address := range w.Addresses() {
+			if _, found := paid[address]; found {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, w := range used {
+		unspent, err := walletUnspent(node, w)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s %d\n", w.Address(), w.Balance(unspent))
+	}
+	fmt.Printf("next unused key: %d\n", next)
+	return nil
+}
+
+// readHDWallet reads a mnemonic from stdin (so it is not kept in the shell history).
+func readHDWallet() (*wallet.HDWallet, error) {
+	fmt.Fprint(os.Stderr, "mnemonic: ")
+	mnemonic, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && mnemonic == "" {
+		return nil, errors.Wrap(err, "failed to read mnemonic")
+	}
+	return wallet.FromMnemonic(mnemonic, *hdPassphrase)
+}
+
+func mine(node *client.Client) error {
+	switch flag.Arg(1) {
+	case "":
+		return printJSON(node.Mine())
+	case "start":
+		return printJSON(node.StartMining())
+	case "stop":
+		return printJSON(node.StopMining())
+	case "status":
+		return printJSON(node.MiningStatus())
+	default:
+		return fmt.Errorf("unknown mine command: %s", flag.Arg(1))
+	}
+}
+
+func printJSON(raw json.RawMessage, err error) error {
+	if err != nil {
+		return err
+	}
+	out := &bytes.Buffer{}
+	if err := json.Indent(out, raw, "", "  "); err != nil {
+		return err
+	}
+	fmt.Println(out.String())
+	return nil
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/satori/go.uuid"
 	"github.com/warmans/catbux/pkg/blocks"
 	"github.com/warmans/catbux/pkg/server"
+	"github.com/warmans/catbux/pkg/store"
 )
 
 const (
@@ -29,23 +30,37 @@ var (
 	clusterSeedNodes      = flag.String("cluster-seed-nodes", "", "address of an existing cluster node(s)")
 	clusterTransferPort   = flag.Int("cluster-trasfer-port", 0, "whenever a large sync occurs it will use this port instead of the gossip port")
 	nodeID                = flag.String("cluster-node-id", "", "Identifier for the node (leaving blank will generate one)")
+	minerAddr             = flag.String("miner-address", "", "address that block rewards are paid to when this node mines a block")
+	miningWorkers         = flag.Int("mining-workers", 0, "number of goroutines used to mine blocks (0 uses one per CPU)")
+	mine                  = flag.Bool("mine", false, "continuously mine blocks in the background (requires -miner-address)")
+	dataDir               = flag.String("data-dir", "", "directory to persist the chain in (leaving blank keeps the chain in memory only)")
+	targetHeight          = flag.Int64("block-version-target-height", blocks.BlockVersionTargetHeight, "index from which older block versions are rejected (a chain with older blocks past it must set a height above its tip)")
 )
 
 func main() {
 	flag.Parse()
 
-	blockchain := blocks.NewBlockchain()
+	blocks.BlockVersionTargetHeight = *targetHeight
+	blockchain := makeBlockchain()
 
-	cluster, transfers := makeCluster(blockchain)
+	pool := blocks.NewTxnPool()
+	cluster, transfers := makeCluster(blockchain, pool)
 	defer func() {
 		cluster.Close()
 		transfers.Close()
+		blockchain.Close()
 	}()
 
-	srv := server.New(*httpBindAddr, blockchain, cluster, transfers)
+	srv := server.New(*httpBindAddr, *minerAddr, blocks.NewMiner(*miningWorkers), blockchain, pool, cluster, transfers)
 	if err := srv.Start(); err != nil {
 		log.Fatal("server failed: " + err.Error())
 	}
+	if *mine {
+		if err := srv.StartMining(); err != nil {
+			log.Fatal("failed to start mining: " + err.Error())
+		}
+		defer srv.StopMining()
+	}
 
 	log.Println("Ready!")
 	terminate := make(chan os.Signal, 1)
@@ -54,7 +69,23 @@ func main() {
 	log.Println("exiting...")
 }
 
-func makeCluster(blockchain *blocks.Blockchain) (*server.Cluster, *server.TransferManager) {
+func makeBlockchain() *blocks.Blockchain {
+	if *dataDir == "" {
+		return blocks.NewBlockchain()
+	}
+	fileStore, err := store.NewFileStore(*dataDir)
+	if err != nil {
+		log.Fatalf("Failed to open data dir: %s", err.Error())
+	}
+	blockchain, err := blocks.LoadBlockchain(fileStore)
+	if err != nil {
+		log.Fatalf("Failed to load chain from %s: %s", *dataDir, err.Error())
+	}
+	log.Printf("Loaded %d blocks from %s", blockchain.Len(), *dataDir)
+	return blockchain
+}
+
+func makeCluster(blockchain *blocks.Blockchain, pool *blocks.TxnPool) (*server.Cluster, *server.TransferManager) {
 	if *nodeID == "" {
 		*nodeID = mustGetNodeID()
 	}
@@ -74,7 +105,7 @@ func makeCluster(blockchain *blocks.Blockchain) (*server.Cluster, *server.Transf
 		}
 	}
 
-	transfers := server.NewTransferManager(blockchain)
+	transfers := server.NewTransferManager(blockchain, pool)
 	go func() {
 		log.Fatal(transfers.Listen(fmt.Sprintf("%s:%d", bindHost, *clusterTransferPort)))
 	}()
@@ -83,6 +114,8 @@ func makeCluster(blockchain *blocks.Blockchain) (*server.Cluster, *server.Transf
 	conf.Init()
 	conf.NodeName = *nodeID
 	conf.Tags = map[string]string{"transfer.port": fmt.Sprintf("%d", *clusterTransferPort)}
+	// events only carry IDs but leave room for long node names
+	conf.UserEventSizeLimit = serf.UserEventSizeLimit
 	conf.MemberlistConfig.BindAddr = bindHost
 	conf.MemberlistConfig.BindPort = bindPort
 	conf.MemberlistConfig.AdvertiseAddr = advertiseHost
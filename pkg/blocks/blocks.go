@@ -1,50 +1,129 @@
 package blocks
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"log"
-	"math"
+	"math/big"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/warmans/catbux/pkg/util"
 )
 
-var Genesis = &Block{Index: 0, Hash: "genesis", Timestamp: time.Time{}, Difficulty: 0, Nonce: 0}
+var Genesis = &Block{BlockHeader: BlockHeader{Index: 0, Timestamp: time.Time{}, Difficulty: 0, Nonce: 0}, Hash: "genesis"}
 
 const (
 	BlockGenerationInterval      = 10
 	DifficultyAdjustmentInterval = 10
+
+	// MaxBlockSize is the largest canonical encoding of a block in bytes.
+	MaxBlockSize = 1 << 20
+	// MaxBlockTxns is the most transactions (including the coinbase) a block can contain.
+	MaxBlockTxns = 2000
+)
+
+const (
+	// BlockVersionLegacy blocks are hashed to base64 and their difficulty is checked against the binary form of the
+	// base64 characters. They are still accepted on chains that have not yet been upgraded.
+	BlockVersionLegacy = 0
+	// BlockVersionRawPoW blocks commit to their version, are hashed to lower case hex and their difficulty is the
+	// number of leading zero bits of the raw SHA-256 digest.
+	BlockVersionRawPoW = 1
+	// BlockVersionTarget blocks replace Difficulty with Bits, a compact 256-bit target that the raw digest must not
+	// exceed. Bits must match the value calculated from the preceding blocks.
+	BlockVersionTarget = 2
+	// BlockVersionHeader blocks commit to their transactions through MerkleRoot and only the fixed size BlockHeader
+	// is hashed.
+	BlockVersionHeader = 3
+	// BlockVersionCanonicalTxn blocks may only contain transactions of TxnVersionCanonical or later.
+	BlockVersionCanonicalTxn = 4
+	// BlockVersionWitness blocks commit to the full canonical encoding of each transaction (see TxnMerkleRoot).
+	// Earlier merkle roots only commit to txn IDs which exclude signatures and witnesses, so a relayed block's
+	// signatures could be replaced without changing its hash.
+	BlockVersionWitness = 5
+
+	// CurrentBlockVersion is the version of newly mined blocks. Once a chain contains a block of a given version all
+	// following blocks must have the same or a later version.
+	CurrentBlockVersion = BlockVersionWitness
 )
 
+// BlockVersionTargetHeight is the index from which blocks must be BlockVersionTarget or later. Chains started before
+// targets were introduced can still contain earlier versions below it. It is a var so that a chain that is already
+// longer can set it to a height above its tip when upgrading. Every node of a chain must use the same value.
+var BlockVersionTargetHeight int64 = 1000
+
+// BlockHeader is the part of a block that is hashed for proof of work (from BlockVersionHeader onwards). The
+// transactions are committed to by MerkleRoot so the header alone is enough to prove a transaction is in a block.
+type BlockHeader struct {
+	Version    int       `json:"version"`
+	Index      int64     `json:"index"`
+	PrevHash   string    `json:"prev_hash"`
+	MerkleRoot string    `json:"merkle_root,omitempty"`
+	Timestamp  time.Time `json:"timestamp"`
+	Difficulty int       `json:"difficulty"`
+	Bits       uint32    `json:"bits,omitempty"`
+	Nonce      int       `json:"nonce"`
+}
+
 type Block struct {
-	Index      int64          `json:"index"`
-	Hash       string         `json:"hash"`
-	PrevHash   string         `json:"prev_hash"`
-	Timestamp  time.Time      `json:"timestamp"`
-	Difficulty int            `json:"difficulty"`
-	Nonce      int            `json:"nonce"`
-	Data       []*Transaction `json:"data"`
+	BlockHeader
+	Hash string         `json:"hash"`
+	Data []*Transaction `json:"data"`
+}
+
+// HeaderHash is the hex encoded SHA-256 digest of the header's canonical encoding. It is the hash of blocks from
+// BlockVersionHeader onwards.
+func HeaderHash(h *BlockHeader) (string, error) {
+	if root, err := hex.DecodeString(h.MerkleRoot); err != nil || len(root) != sha256.Size {
+		return "", fmt.Errorf("merkle root was not a hex encoded SHA-256 digest: %s", h.MerkleRoot)
+	}
+	encoded, err := h.MarshalBinary()
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(encoded)
+	return hex.EncodeToString(digest[:]), nil
 }
 
 func Hash(b *Block) (string, error) {
+	if b.Version >= BlockVersionHeader {
+		return HeaderHash(&b.BlockHeader)
+	}
 	hash := sha256.New()
+	if b.Version != BlockVersionLegacy {
+		fmt.Fprintf(hash, "v%d:", b.Version)
+	}
 	fmt.Fprintf(hash, "%d", b.Index)
 	fmt.Fprintf(hash, "%s", b.PrevHash)
 	fmt.Fprintf(hash, "%s", b.Timestamp.Format(time.RFC3339Nano))
 	fmt.Fprintf(hash, "%d", b.Difficulty)
+	if b.Version >= BlockVersionTarget {
+		fmt.Fprintf(hash, ":%d:", b.Bits)
+	}
 	fmt.Fprintf(hash, "%d", b.Nonce)
 	if err := json.NewEncoder(hash).Encode(b.Data); err != nil {
 		return "", err
 	}
-	return base64.URLEncoding.EncodeToString(hash.Sum(nil)), nil
+	if b.Version == BlockVersionLegacy {
+		return base64.URLEncoding.EncodeToString(hash.Sum(nil)), nil
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
 func IsValidBlock(newBlock, prevBlock *Block) error {
+	// version is known and has not gone backwards
+	if newBlock.Version < prevBlock.Version || newBlock.Version > CurrentBlockVersion {
+		return fmt.Errorf("block version %d is not valid after version %d", newBlock.Version, prevBlock.Version)
+	}
+	if newBlock.Index >= BlockVersionTargetHeight && newBlock.Version < BlockVersionTarget {
+		return fmt.Errorf("block version %d is not valid from block %d", newBlock.Version, BlockVersionTargetHeight)
+	}
 	// index is valid
 	if expectedIndex := prevBlock.Index + 1; expectedIndex != newBlock.Index {
 		return fmt.Errorf("index was wrong: expected %d got %d", expectedIndex, newBlock.Index)
@@ -53,6 +132,28 @@ func IsValidBlock(newBlock, prevBlock *Block) error {
 	if prevBlock.Hash != newBlock.PrevHash {
 		return fmt.Errorf("preceeding hash was wrong: expected %s got %s", prevBlock.Hash, newBlock.PrevHash)
 	}
+	// transactions match the header
+	if err := validateMerkleRoot(newBlock); err != nil {
+		return err
+	}
+	if encoded, err := newBlock.MarshalBinary(); err != nil {
+		return err
+	} else if len(encoded) > MaxBlockSize {
+		return fmt.Errorf("block was %d bytes (maximum %d)", len(encoded), MaxBlockSize)
+	}
+	// block is within limits
+	if len(newBlock.Data) > MaxBlockTxns {
+		return fmt.Errorf("block contained %d txns (maximum %d)", len(newBlock.Data), MaxBlockTxns)
+	}
+	// transactions are present and of a version allowed in the block
+	for k, txn := range newBlock.Data {
+		if txn == nil {
+			return fmt.Errorf("txn %d was missing", k)
+		}
+		if newBlock.Version >= BlockVersionCanonicalTxn && txn.Version < TxnVersionCanonical {
+			return fmt.Errorf("txn %s version %d is not allowed in block version %d", txn.ID, txn.Version, newBlock.Version)
+		}
+	}
 	// hash matches content
 	blockHash, err := Hash(newBlock)
 	if err != nil {
@@ -66,34 +167,57 @@ func IsValidBlock(newBlock, prevBlock *Block) error {
 		return err
 	}
 	// hash is correct for the specified difficulty
-	if err := hashMatchesDifficulty(newBlock.Hash, newBlock.Difficulty); err != nil {
+	if err := hashMatchesDifficulty(newBlock); err != nil {
 		return err
 	}
 	return nil
 }
 
+// FindNonce mines the block using all CPUs. It does not return until a nonce is found; use a Miner to be able to
+// cancel mining.
 func FindNonce(block *Block) error {
-	start := time.Now()
-	defer func() {
-		log.Printf("Found block nonce %d in %0.2f seconds", block.Nonce, time.Since(start).Seconds())
-	}()
-	for {
-		var err error
-		block.Hash, err = Hash(block)
-		if err != nil {
-			return err
+	return NewMiner(0).Mine(context.Background(), block)
+}
+
+func validateMerkleRoot(b *Block) error {
+	if b.Version < BlockVersionHeader {
+		if b.MerkleRoot != "" {
+			return fmt.Errorf("block version %d cannot have a merkle root", b.Version)
 		}
-		if err := hashMatchesDifficulty(block.Hash, block.Difficulty); err == nil {
+		return nil
+	}
+	if root := TxnMerkleRoot(b.Version, b.Data); root != b.MerkleRoot {
+		return fmt.Errorf("merkle root was wrong: expected %s got %s", root, b.MerkleRoot)
+	}
+	return nil
+}
+
+func hashMatchesDifficulty(b *Block) error {
+	if b.Version == BlockVersionLegacy {
+		return legacyHashMatchesDifficulty(b.Hash, b.Difficulty)
+	}
+	digest, err := hex.DecodeString(b.Hash)
+	if err != nil || len(digest) != sha256.Size {
+		return fmt.Errorf("block hash was not a hex encoded SHA-256 digest: %s", b.Hash)
+	}
+	if b.Version >= BlockVersionTarget {
+		if err := validateBits(b.Bits); err != nil {
 			return err
 		}
-		block.Nonce++
+		if new(big.Int).SetBytes(digest).Cmp(CompactToTarget(b.Bits)) > 0 {
+			return fmt.Errorf("hash was above the required target (bits %08x)", b.Bits)
+		}
+		return nil
+	}
+	if zeros := util.LeadingZeroBits(digest); zeros < b.Difficulty {
+		return fmt.Errorf("hash did not match required difficulty (required %d leading zero bits but hash had %d)", b.Difficulty, zeros)
 	}
 	return nil
 }
 
-func hashMatchesDifficulty(hash string, difficulty int) error {
+// legacyHashMatchesDifficulty checks the difficulty of BlockVersionLegacy blocks.
+func legacyHashMatchesDifficulty(hash string, difficulty int) error {
 	bin := util.HexToBin(hash)
-	log.Println(bin)
 	if len(bin) < difficulty {
 		return fmt.Errorf("hash binary was not long enough (binary: %d difficulty: %d)", len(bin), difficulty)
 	}
@@ -104,12 +228,31 @@ func hashMatchesDifficulty(hash string, difficulty int) error {
 }
 
 func NewBlockchain() *Blockchain {
-	return &Blockchain{Blocks: []*Block{Genesis}}
+	chain := &Blockchain{Blocks: []*Block{Genesis}, unspent: NewTxnOutUnspentSet(), deltas: []*TxnOutUnspentDelta{nil}}
+	chain.indexMainChain()
+	return chain
 }
 
 type Blockchain struct {
 	Blocks []*Block `json:"blocks"`
 	sync.RWMutex
+
+	// unspent is the set of txn outs that can be spent as of the last block.
+	unspent *TxnOutUnspentSet
+
+	// store persists appended blocks. It is nil for chains that only exist in memory.
+	store Store
+
+	// deltas holds the changes each main chain block made to unspent so they can be rolled back during a reorg.
+	deltas []*TxnOutUnspentDelta
+
+	// nodes contains every valid block on the main chain or a side chain keyed by hash.
+	nodes map[string]*blockNode
+
+	// orphans contains blocks whose parent is not yet known keyed by hash.
+	orphans map[string]*Block
+
+	subscribers []chan *ChainEvent
 }
 
 func (c *Blockchain) Last() *Block {
@@ -118,14 +261,29 @@ func (c *Blockchain) Last() *Block {
 	return c.Blocks[len(c.Blocks)-1]
 }
 
+// HasBlock reports whether the block with the given hash is known (on any branch or as an orphan).
+func (c *Blockchain) HasBlock(hash string) bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	if _, found := c.nodes[hash]; found {
+		return true
+	}
+	_, found := c.orphans[hash]
+	return found
+}
+
+// Append adds a block to the chain. Blocks that extend the tip are added to the main chain, blocks that extend
+// another known block are kept as a side chain (switching to it if it has more cumulative work) and blocks with an
+// unknown parent are kept as orphans until the parent arrives. ErrOrphanBlock is returned in the last case.
 func (c *Blockchain) Append(block *Block) error {
+	var events []*ChainEvent
 	err := c.writeLock(func() error {
-		if err := IsValidBlock(block, c.Blocks[len(c.Blocks)-1]); err != nil {
-			return err
-		}
-		c.Blocks = append(c.Blocks, block)
-		return nil
+		var err error
+		events, err = c.addBlock(block)
+		return err
 	})
+	c.notify(events)
 	return err
 }
 
@@ -133,18 +291,37 @@ func (c *Blockchain) IsValid() error {
 	c.RLock()
 	defer c.RUnlock()
 
+	_, _, err := c.validate()
+	return err
+}
+
+// validate checks every block in the chain and returns the unspent txn outs resulting from replaying all
+// transactions from the genesis block along with the change each block made to them.
+func (c *Blockchain) validate() (*TxnOutUnspentSet, []*TxnOutUnspentDelta, error) {
 	if len(c.Blocks) == 0 {
-		return fmt.Errorf("genesis block was missing")
+		return nil, nil, fmt.Errorf("genesis block was missing")
 	}
 	if c.Blocks[0].Hash != Genesis.Hash {
-		return fmt.Errorf("genesis block was unexpected: %+v", Genesis)
+		return nil, nil, fmt.Errorf("genesis block was unexpected: %+v", Genesis)
 	}
+	unspent := NewTxnOutUnspentSet()
+	deltas := []*TxnOutUnspentDelta{nil}
+	parent := &blockNode{block: c.Blocks[0], work: blockWork(c.Blocks[0])}
 	for k := 1; k < len(c.Blocks); k++ {
 		if err := IsValidBlock(c.Blocks[k], c.Blocks[k-1]); err != nil {
-			return err
+			return nil, nil, err
 		}
+		if err := validateBlockBits(c.Blocks[k], parent); err != nil {
+			return nil, nil, err
+		}
+		parent = &blockNode{block: c.Blocks[k], parent: parent, work: new(big.Int).Add(parent.work, blockWork(c.Blocks[k]))}
+		delta, err := ProcessTransactions(c.Blocks[k], unspent)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "block %d contained invalid transactions", c.Blocks[k].Index)
+		}
+		deltas = append(deltas, delta)
 	}
-	return nil
+	return unspent, deltas, nil
 }
 
 func (c *Blockchain) Snapshot() *Blockchain {
@@ -166,47 +343,149 @@ func (c *Blockchain) Len() int64 {
 	return int64(len(c.Blocks))
 }
 
+// Replace adds all blocks from the given chain that are not already known. The main chain switches to them if they
+// have more cumulative work than the current main chain.
 func (c *Blockchain) Replace(chain *Blockchain) error {
-	return c.writeLock(func() error {
-		if err := chain.IsValid(); err != nil {
-			return err
-		}
-		if chain.GetChainDifficulty() > c.GetChainDifficulty() {
-			c.Blocks = chain.Blocks
+	chain.RLock()
+	replacement := chain.Blocks
+	chain.RUnlock()
+
+	if len(replacement) == 0 || replacement[0].Hash != Genesis.Hash {
+		return fmt.Errorf("replacement chain did not start with the genesis block")
+	}
+
+	var events []*ChainEvent
+	err := c.writeLock(func() error {
+		for _, b := range replacement[1:] {
+			evs, err := c.addBlock(b)
+			if err == ErrBlockExists {
+				continue
+			}
+			if err != nil {
+				return errors.Wrapf(err, "block %d was rejected", b.Index)
+			}
+			events = append(events, evs...)
 		}
 		return nil
 	})
+	c.notify(events)
+	return err
 }
 
-func (c *Blockchain) GetChainDifficulty() int64 {
-	total := 0.0
+// GetChainDifficulty is the cumulative work of the main chain i.e. the expected number of hashes needed to mine it.
+func (c *Blockchain) GetChainDifficulty() *big.Int {
+	c.RLock()
+	defer c.RUnlock()
+
+	total := big.NewInt(0)
 	for _, b := range c.Blocks {
-		total += math.Pow(2, float64(b.Difficulty))
+		total.Add(total, blockWork(b))
 	}
-	return int64(total)
+	return total
+}
+
+// NextBits is the compact target required of the next block on the main chain.
+func (c *Blockchain) NextBits() uint32 {
+	c.RLock()
+	defer c.RUnlock()
+
+	return nextBits(c.nodes[c.Blocks[len(c.Blocks)-1].Hash])
 }
 
-func (c *Blockchain) GetCurrentDifficulty() int {
-	lastBlock := c.Blocks[len(c.Blocks)-1]
-	if lastBlock.Index%DifficultyAdjustmentInterval == 0 && lastBlock.Index != 0 {
-		return c.getAdjustedDifficulty(lastBlock)
+// FindTransaction returns a copy of the main chain block containing the transaction with the given ID and the
+// number of confirmations it has (1 if it is in the tip). The block is nil if the transaction is not on the chain.
+func (c *Blockchain) FindTransaction(id string) (*Block, int64) {
+	c.RLock()
+	defer c.RUnlock()
+
+	for k := len(c.Blocks) - 1; k >= 0; k-- {
+		for _, txn := range c.Blocks[k].Data {
+			if txn.ID == id {
+				deref := *c.Blocks[k]
+				return &deref, int64(len(c.Blocks) - k)
+			}
+		}
 	}
-	return lastBlock.Difficulty
+	return nil, 0
+}
 
+// BlockRef identifies a block by index and hash.
+type BlockRef struct {
+	Index int64  `json:"index"`
+	Hash  string `json:"hash"`
 }
 
-func (c *Blockchain) getAdjustedDifficulty(lastBlock *Block) int {
+// Locator returns references to blocks in the chain starting at the tip, stepping back one block at a time for the
+// most recent blocks and then exponentially further, always ending with the genesis block. A peer can use it to find
+// the most recent block both chains have in common.
+func (c *Blockchain) Locator() []BlockRef {
+	c.RLock()
+	defer c.RUnlock()
 
-	prevAdjustmentBlock := c.Blocks[len(c.Blocks)-DifficultyAdjustmentInterval]
-	timeExpected := float64(BlockGenerationInterval * DifficultyAdjustmentInterval)
-	timeTaken := lastBlock.Timestamp.Sub(prevAdjustmentBlock.Timestamp)
+	locator := []BlockRef{}
+	step := 1
+	for k := len(c.Blocks) - 1; k > 0; k -= step {
+		locator = append(locator, BlockRef{Index: c.Blocks[k].Index, Hash: c.Blocks[k].Hash})
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	return append(locator, BlockRef{Index: c.Blocks[0].Index, Hash: c.Blocks[0].Hash})
+}
 
-	if timeTaken.Seconds() < timeExpected/2 {
-		return prevAdjustmentBlock.Difficulty + 1
-	} else if timeTaken.Seconds() > timeExpected*2 {
-		return prevAdjustmentBlock.Difficulty - 1
+// BlocksAfter finds the first block in the locator that is also part of this chain and returns its index along with
+// up to max blocks that follow it. If no block in the locator is known the fork index is -1.
+func (c *Blockchain) BlocksAfter(locator []BlockRef, max int) (int64, []*Block) {
+	c.RLock()
+	defer c.RUnlock()
+
+	fork := int64(-1)
+	for _, ref := range locator {
+		if ref.Index >= 0 && ref.Index < int64(len(c.Blocks)) && c.Blocks[ref.Index].Hash == ref.Hash {
+			fork = ref.Index
+			break
+		}
+	}
+	if fork == -1 {
+		return fork, []*Block{}
+	}
+	end := fork + 1 + int64(max)
+	if end > int64(len(c.Blocks)) {
+		end = int64(len(c.Blocks))
 	}
-	return prevAdjustmentBlock.Difficulty
+	result := make([]*Block, 0, end-fork-1)
+	for _, b := range c.Blocks[fork+1 : end] {
+		deref := *b
+		result = append(result, &deref)
+	}
+	return fork, result
+}
+
+// Close releases the chain's store (if any).
+func (c *Blockchain) Close() error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.store == nil {
+		return nil
+	}
+	return c.store.Close()
+}
+
+// ReadUnspent calls f with the current unspent txn out set. The chain will not change until f returns.
+func (c *Blockchain) ReadUnspent(f func(unspent *TxnOutUnspentSet) error) error {
+	c.RLock()
+	defer c.RUnlock()
+	return f(c.unspent)
+}
+
+// ReadTip calls f with the last block of the main chain, the bits required of the block that follows it and the
+// unspent txn out set as of that block. The chain will not change until f returns.
+func (c *Blockchain) ReadTip(f func(tip *Block, bits uint32, unspent *TxnOutUnspentSet) error) error {
+	c.RLock()
+	defer c.RUnlock()
+	tip := c.Blocks[len(c.Blocks)-1]
+	return f(tip, nextBits(c.nodes[tip.Hash]), c.unspent)
 }
 
 func (c *Blockchain) writeLock(f func() error) error {
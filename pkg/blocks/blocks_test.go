@@ -0,0 +1,80 @@
+package blocks
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsValidBlockRejectsOldVersionsAfterTargetHeight(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  int
+		index    int64
+		rejected bool
+	}{
+		{name: "legacy before activation", version: BlockVersionLegacy, index: BlockVersionTargetHeight - 1},
+		{name: "raw pow before activation", version: BlockVersionRawPoW, index: BlockVersionTargetHeight - 1},
+		{name: "legacy at activation", version: BlockVersionLegacy, index: BlockVersionTargetHeight, rejected: true},
+		{name: "raw pow at activation", version: BlockVersionRawPoW, index: BlockVersionTargetHeight, rejected: true},
+		{name: "raw pow after activation", version: BlockVersionRawPoW, index: BlockVersionTargetHeight + 1, rejected: true},
+		{name: "target at activation", version: BlockVersionTarget, index: BlockVersionTargetHeight},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			prev := &Block{BlockHeader: BlockHeader{Version: BlockVersionLegacy, Index: test.index - 1}, Hash: "prev"}
+			block := &Block{BlockHeader: BlockHeader{Version: test.version, Index: test.index, PrevHash: "prev"}}
+
+			// the block is never fully valid (it is not mined) so only the version error is checked for
+			err := IsValidBlock(block, prev)
+			rejected := err != nil && strings.Contains(err.Error(), "is not valid from block")
+			if rejected != test.rejected {
+				t.Fatalf("expected rejected=%v got error: %v", test.rejected, err)
+			}
+		})
+	}
+}
+
+// versionTestBlock mines a block of the given version after parent.
+func versionTestBlock(t *testing.T, parent *Block, version int) *Block {
+	block := mineTestBlock(t, parent, "miner")
+	block.Version = version
+	block.MerkleRoot = ""
+	if version < BlockVersionTarget {
+		block.Bits = 0
+	}
+	if err := FindNonce(block); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func TestLegacyChainCrossingTargetHeight(t *testing.T) {
+	defer func(height int64) { BlockVersionTargetHeight = height }(BlockVersionTargetHeight)
+	BlockVersionTargetHeight = 3
+
+	chain, store := testChain(t)
+	legacy := []*Block{versionTestBlock(t, Genesis, BlockVersionLegacy)}
+	legacy = append(legacy, versionTestBlock(t, legacy[0], BlockVersionLegacy))
+	appendBlocks(t, chain, legacy...)
+
+	for _, version := range []int{BlockVersionLegacy, BlockVersionRawPoW} {
+		if err := chain.Append(versionTestBlock(t, legacy[1], version)); err == nil || !strings.Contains(err.Error(), "is not valid from block 3") {
+			t.Fatalf("expected version %d block to be rejected at the target height got %v", version, err)
+		}
+	}
+	upgraded := versionTestBlock(t, legacy[1], BlockVersionTarget)
+	appendBlocks(t, chain, upgraded, mineTestBlock(t, upgraded, "miner"))
+	if chain.Last().Index != 4 {
+		t.Fatalf("expected chain to continue past the target height, tip was %d", chain.Last().Index)
+	}
+
+	// a chain that already has older blocks past the target height only loads once the height is moved above them
+	store.blocks = append(store.blocks[:3], versionTestBlock(t, legacy[1], BlockVersionLegacy))
+	if _, err := LoadBlockchain(store); err == nil {
+		t.Fatal("expected stored chain with legacy blocks past the target height to be invalid")
+	}
+	BlockVersionTargetHeight = 4
+	if _, err := LoadBlockchain(store); err != nil {
+		t.Fatalf("expected stored chain to load with a later target height: %s", err)
+	}
+}
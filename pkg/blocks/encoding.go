@@ -0,0 +1,356 @@
+package blocks
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The canonical encoding is used wherever blocks or transactions are hashed. Integers are fixed size and big endian,
+// strings and lists are prefixed with their length as a uint32 and times are encoded as unix seconds followed by
+// nanoseconds. Derived fields (hashes and IDs) are never part of the encoding of the thing they are derived from.
+
+// MarshalBinary returns the canonical encoding of the header.
+func (h *BlockHeader) MarshalBinary() ([]byte, error) {
+	return encode(func(e *encoder) { e.writeHeader(h) })
+}
+
+// MarshalBinary returns the canonical encoding of the block's header followed by its transactions.
+func (b *Block) MarshalBinary() ([]byte, error) {
+	return encode(func(e *encoder) {
+		e.writeHeader(&b.BlockHeader)
+		e.writeUint32(uint32(len(b.Data)))
+		for _, txn := range b.Data {
+			e.writeTxn(txn, true)
+		}
+	})
+}
+
+// MarshalBinary returns the canonical encoding of the transaction including the signature of each txn in.
+func (t *Transaction) MarshalBinary() ([]byte, error) {
+	return encode(func(e *encoder) { e.writeTxn(t, true) })
+}
+
+// MarshalBinary returns the canonical encoding of the txn in as part of a CurrentTxnVersion transaction.
+func (t *TxnIn) MarshalBinary() ([]byte, error) {
+	return encode(func(e *encoder) { e.writeTxnIn(t, CurrentTxnVersion, true) })
+}
+
+// MarshalBinary returns the canonical encoding of the txn out as part of a CurrentTxnVersion transaction.
+func (t *TxnOut) MarshalBinary() ([]byte, error) {
+	return encode(func(e *encoder) { e.writeTxnOut(t, CurrentTxnVersion) })
+}
+
+// UnmarshalBinary decodes the canonical encoding of a block. The block's hash is not part of the encoding so is left
+// empty, the timestamp is in UTC and transaction IDs are recalculated.
+func (b *Block) UnmarshalBinary(data []byte) error {
+	d := &decoder{data: data}
+	block := Block{Data: []*Transaction{}}
+	d.readHeader(&block.BlockHeader)
+	for n := d.readCount(minTxnSize); n > 0 && d.err == nil; n-- {
+		block.Data = append(block.Data, d.readTxn())
+	}
+	if err := d.finish(); err != nil {
+		return errors.Wrap(err, "failed to decode block")
+	}
+	*b = block
+	return nil
+}
+
+// UnmarshalBinary decodes the canonical encoding of a transaction. The ID is recalculated.
+func (t *Transaction) UnmarshalBinary(data []byte) error {
+	d := &decoder{data: data}
+	txn := d.readTxn()
+	if err := d.finish(); err != nil {
+		return errors.Wrap(err, "failed to decode transaction")
+	}
+	t.Version, t.ID, t.LockTime, t.TxnOut = txn.Version, txn.ID, txn.LockTime, txn.TxnOut
+	t.TxnIn.mu.Lock()
+	t.TxnIn.set, t.TxnIn.index = txn.TxnIn.set, txn.TxnIn.index
+	t.TxnIn.mu.Unlock()
+	return nil
+}
+
+func encode(f func(e *encoder)) ([]byte, error) {
+	buff := &bytes.Buffer{}
+	e := &encoder{w: buff}
+	f(e)
+	if e.err != nil {
+		return nil, e.err
+	}
+	return buff.Bytes(), nil
+}
+
+// canonicalTxnID is the ID of transactions from TxnVersionCanonical onwards. Signatures are not part of the ID as
+// they sign it.
+func canonicalTxnID(t *Transaction) string {
+	hash := sha256.New()
+	e := &encoder{w: hash}
+	e.writeTxn(t, false)
+	return base64.URLEncoding.EncodeToString(hash.Sum(nil))
+}
+
+// encoder writes the canonical encoding. The first error is kept and all following writes are skipped.
+type encoder struct {
+	w   io.Writer
+	err error
+}
+
+func (e *encoder) write(v interface{}) {
+	if e.err != nil {
+		return
+	}
+	e.err = binary.Write(e.w, binary.BigEndian, v)
+}
+
+func (e *encoder) writeUint32(v uint32) {
+	e.write(v)
+}
+
+func (e *encoder) writeInt64(v int64) {
+	e.write(v)
+}
+
+func (e *encoder) writeBytes(b []byte) {
+	e.writeUint32(uint32(len(b)))
+	e.write(b)
+}
+
+func (e *encoder) writeString(s string) {
+	e.writeBytes([]byte(s))
+}
+
+func (e *encoder) writeTime(t time.Time) {
+	e.writeInt64(t.Unix())
+	e.write(int32(t.Nanosecond()))
+}
+
+// writeHeader writes the header with the merkle root as a fixed 32 bytes. Blocks before BlockVersionHeader have no
+// merkle root and are written with zeros in its place.
+func (e *encoder) writeHeader(h *BlockHeader) {
+	root := make([]byte, sha256.Size)
+	if h.MerkleRoot != "" {
+		decoded, err := hex.DecodeString(h.MerkleRoot)
+		if err != nil || len(decoded) != sha256.Size {
+			if e.err == nil {
+				e.err = fmt.Errorf("merkle root was not a hex encoded SHA-256 digest: %s", h.MerkleRoot)
+			}
+			return
+		}
+		root = decoded
+	}
+	e.writeUint32(uint32(h.Version))
+	e.writeInt64(h.Index)
+	e.writeString(h.PrevHash)
+	e.write(root)
+	e.writeTime(h.Timestamp)
+	e.writeInt64(int64(h.Difficulty))
+	e.writeUint32(h.Bits)
+	e.writeInt64(int64(h.Nonce))
+}
+
+// writeTxn writes the transaction. Fields added by later transaction versions are only written for those versions.
+func (e *encoder) writeTxn(t *Transaction, withSignatures bool) {
+	e.writeUint32(uint32(t.Version))
+	if t.Version >= TxnVersionLockTime {
+		e.writeInt64(t.LockTime)
+	}
+
+	t.TxnIn.mu.RLock()
+	e.writeUint32(uint32(len(t.TxnIn.set)))
+	for _, in := range t.TxnIn.set {
+		e.writeTxnIn(in, t.Version, withSignatures)
+	}
+	t.TxnIn.mu.RUnlock()
+
+	e.writeUint32(uint32(len(t.TxnOut)))
+	for _, out := range t.TxnOut {
+		e.writeTxnOut(out, t.Version)
+	}
+}
+
+// writeTxnIn writes the txn in. The signature, witness and pub key are only written if withSignature is set.
+func (e *encoder) writeTxnIn(t *TxnIn, version int, withSignature bool) {
+	e.writeString(t.TxnOutID)
+	e.writeInt64(t.TxnOutIndex)
+	if withSignature {
+		e.writeString(t.Signature)
+	}
+	if version >= TxnVersionLockTime {
+		e.writeInt64(t.RelativeLock)
+	}
+	if version >= TxnVersionLock && withSignature {
+		witness := t.Witness
+		if witness == nil {
+			witness = &Witness{}
+		}
+		e.writeStrings(witness.Signatures)
+		e.writeStrings(witness.Preimages)
+	}
+	if version >= TxnVersionPubKeyHash && withSignature {
+		e.writeString(t.PubKey)
+	}
+}
+
+func (e *encoder) writeTxnOut(t *TxnOut, version int) {
+	e.writeString(t.Address)
+	e.writeInt64(t.Amount)
+	if version >= TxnVersionLock {
+		e.writeString(t.Lock)
+	}
+}
+
+func (e *encoder) writeStrings(s []string) {
+	e.writeUint32(uint32(len(s)))
+	for _, v := range s {
+		e.writeString(v)
+	}
+}
+
+// The smallest possible encoding of each list element. Used to reject list lengths that could not fit in the
+// remaining data before allocating anything.
+const (
+	minTxnSize    = 4 + 4 + 4
+	minTxnInSize  = 4 + 8 + 4
+	minTxnOutSize = 4 + 8
+)
+
+// decoder reads the canonical encoding. The first error is kept and all following reads return zero values.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.data) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) readUint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) readInt64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) readBytes() []byte {
+	return d.next(int(d.readUint32()))
+}
+
+func (d *decoder) readString() string {
+	return string(d.readBytes())
+}
+
+func (d *decoder) readStrings() []string {
+	n := d.readCount(4)
+	if n == 0 {
+		return nil
+	}
+	s := make([]string, 0, n)
+	for ; n > 0 && d.err == nil; n-- {
+		s = append(s, d.readString())
+	}
+	return s
+}
+
+func (d *decoder) readTime() time.Time {
+	sec := d.readInt64()
+	nsec := int32(d.readUint32())
+	return time.Unix(sec, int64(nsec)).UTC()
+}
+
+// readCount reads the length of a list of elements that are each at least minSize bytes.
+func (d *decoder) readCount(minSize int) int {
+	n := int(d.readUint32())
+	if d.err == nil && n > len(d.data)/minSize {
+		d.err = fmt.Errorf("list of %d elements was longer than the remaining data", n)
+		return 0
+	}
+	return n
+}
+
+// finish checks all data was decoded without error.
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) != 0 {
+		d.err = fmt.Errorf("%d bytes of unexpected trailing data", len(d.data))
+	}
+	return d.err
+}
+
+func (d *decoder) readHeader(h *BlockHeader) {
+	h.Version = int(d.readUint32())
+	h.Index = d.readInt64()
+	h.PrevHash = d.readString()
+	root := d.next(sha256.Size)
+	h.Timestamp = d.readTime()
+	h.Difficulty = int(d.readInt64())
+	h.Bits = d.readUint32()
+	h.Nonce = int(d.readInt64())
+	if root != nil && (h.Version >= BlockVersionHeader || !bytes.Equal(root, make([]byte, sha256.Size))) {
+		h.MerkleRoot = hex.EncodeToString(root)
+	}
+}
+
+func (d *decoder) readTxn() *Transaction {
+	txn := &Transaction{Version: int(d.readUint32())}
+	locks := txn.Version >= TxnVersionLockTime
+	if locks {
+		txn.LockTime = d.readInt64()
+	}
+
+	n := d.readCount(minTxnInSize)
+	txn.TxnIn.set = make([]*TxnIn, 0, n)
+	txn.TxnIn.index = make(map[TxnOutRef]struct{}, n)
+	for ; n > 0 && d.err == nil; n-- {
+		in := &TxnIn{TxnOutID: d.readString(), TxnOutIndex: d.readInt64(), Signature: d.readString()}
+		if locks {
+			in.RelativeLock = d.readInt64()
+		}
+		if txn.Version >= TxnVersionLock {
+			signatures, preimages := d.readStrings(), d.readStrings()
+			if len(signatures) > 0 || len(preimages) > 0 {
+				in.Witness = &Witness{Signatures: signatures, Preimages: preimages}
+			}
+		}
+		if txn.Version >= TxnVersionPubKeyHash {
+			in.PubKey = d.readString()
+		}
+		txn.TxnIn.set = append(txn.TxnIn.set, in)
+		txn.TxnIn.index[TxnOutRef{TxnOutID: in.TxnOutID, TxnOutIndex: in.TxnOutIndex}] = struct{}{}
+	}
+
+	n = d.readCount(minTxnOutSize)
+	txn.TxnOut = make([]*TxnOut, 0, n)
+	for ; n > 0 && d.err == nil; n-- {
+		out := &TxnOut{Address: d.readString(), Amount: d.readInt64()}
+		if txn.Version >= TxnVersionLock {
+			out.Lock = d.readString()
+		}
+		txn.TxnOut = append(txn.TxnOut, out)
+	}
+
+	txn.ID = GetTransactionID(txn)
+	return txn
+}
@@ -0,0 +1,204 @@
+package blocks
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+// goldenHex joins hex fragments so each field of an expected encoding can be written on its own line.
+func goldenHex(t *testing.T, fragments ...string) []byte {
+	b, err := hex.DecodeString(strings.Join(fragments, ""))
+	if err != nil {
+		t.Fatalf("bad golden hex: %s", err)
+	}
+	return b
+}
+
+func goldenHeader() *BlockHeader {
+	return &BlockHeader{
+		Version:    BlockVersionCanonicalTxn,
+		Index:      1,
+		PrevHash:   "ab",
+		MerkleRoot: strings.Repeat("11", 32),
+		Timestamp:  time.Unix(1600000000, 5),
+		Bits:       0x1f00ffff,
+		Nonce:      42,
+	}
+}
+
+func goldenTxnIn() *TxnIn {
+	return &TxnIn{TxnOutID: "id", TxnOutIndex: 1, Signature: "sig", RelativeLock: 2, PubKey: "pk"}
+}
+
+func goldenTxnOut() *TxnOut {
+	return &TxnOut{Address: "ad", Amount: 50}
+}
+
+func goldenTxn(version int) *Transaction {
+	txn := &Transaction{Version: version, LockTime: 7, TxnOut: []*TxnOut{goldenTxnOut()}}
+	txn.TxnIn.Append(goldenTxnIn())
+	return txn
+}
+
+var (
+	goldenHeaderHex = []string{
+		"00000004",         // version
+		"0000000000000001", // index
+		"00000002", "6162", // prev hash
+		strings.Repeat("11", 32), // merkle root
+		"000000005f5e1000",       // timestamp seconds
+		"00000005",               // timestamp nanoseconds
+		"0000000000000000",       // difficulty
+		"1f00ffff",               // bits
+		"000000000000002a",       // nonce
+	}
+	goldenTxnInHex = []string{
+		"00000002", "6964", // txn out id
+		"0000000000000001",   // txn out index
+		"00000003", "736967", // signature
+		"0000000000000002", // relative lock
+		"00000000",         // witness signatures
+		"00000000",         // witness preimages
+		"00000002", "706b", // pub key
+	}
+	goldenTxnOutHex = []string{
+		"00000002", "6164", // address
+		"0000000000000032", // amount
+		"00000000",         // lock
+	}
+)
+
+func goldenTxnHex() []string {
+	fragments := []string{
+		"00000004",         // version
+		"0000000000000007", // lock time
+		"00000001",         // txn in count
+	}
+	fragments = append(fragments, goldenTxnInHex...)
+	fragments = append(fragments, "00000001") // txn out count
+	return append(fragments, goldenTxnOutHex...)
+}
+
+func TestMarshalBinaryGolden(t *testing.T) {
+	block := &Block{BlockHeader: *goldenHeader(), Data: []*Transaction{goldenTxn(TxnVersionPubKeyHash)}}
+
+	tests := []struct {
+		name      string
+		marshal   func() ([]byte, error)
+		fragments []string
+	}{
+		{name: "header", marshal: goldenHeader().MarshalBinary, fragments: goldenHeaderHex},
+		{name: "txn in", marshal: goldenTxnIn().MarshalBinary, fragments: goldenTxnInHex},
+		{name: "txn out", marshal: goldenTxnOut().MarshalBinary, fragments: goldenTxnOutHex},
+		{name: "txn", marshal: goldenTxn(TxnVersionPubKeyHash).MarshalBinary, fragments: goldenTxnHex()},
+		{
+			name:    "block",
+			marshal: block.MarshalBinary,
+			fragments: append(append(append([]string{}, goldenHeaderHex...),
+				"00000001"), // txn count
+				goldenTxnHex()...),
+		},
+		{
+			// fields added by later versions are not written
+			name:    "canonical txn",
+			marshal: goldenTxn(TxnVersionCanonical).MarshalBinary,
+			fragments: []string{
+				"00000001",         // version
+				"00000001",         // txn in count
+				"00000002", "6964", // txn out id
+				"0000000000000001",   // txn out index
+				"00000003", "736967", // signature
+				"00000001",         // txn out count
+				"00000002", "6164", // address
+				"0000000000000032", // amount
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.marshal()
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if expected := goldenHex(t, test.fragments...); !bytes.Equal(got, expected) {
+				t.Fatalf("encoding changed\nexpected: %x\ngot:      %x", expected, got)
+			}
+		})
+	}
+}
+
+func TestCanonicalTxnIDGolden(t *testing.T) {
+	tests := []struct {
+		name     string
+		txn      *Transaction
+		expected string
+	}{
+		{name: "current", txn: goldenTxn(TxnVersionPubKeyHash), expected: "rvRn_hHmOcefjJ_OHDsNz1aZu1q5DhLtGqpR4RToUvA="},
+		{name: "canonical", txn: goldenTxn(TxnVersionCanonical), expected: "lt2aN4asbizOVmgnEb9PONmAWUiQuDY_2OlcDm03Pxs="},
+		{name: "coinbase", txn: NewCoinbaseTransaction("ad", 3, 0), expected: "YJ0z4GwEp-Ip9vvHLicpGtFx2mPSxpWWoEUQ57d1L_U="},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := canonicalTxnID(test.txn); got != test.expected {
+				t.Fatalf("expected ID %s got %s", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestCanonicalTxnIDExcludesSignatures(t *testing.T) {
+	txn := goldenTxn(TxnVersionPubKeyHash)
+	id := canonicalTxnID(txn)
+
+	in, _ := txn.GetTxnIn(0)
+	in.Signature, in.PubKey, in.Witness = "other", "other", &Witness{Signatures: []string{"other"}}
+	if got := canonicalTxnID(txn); got != id {
+		t.Fatalf("changing signatures changed the ID from %s to %s", id, got)
+	}
+
+	in.RelativeLock = 3
+	if got := canonicalTxnID(txn); got == id {
+		t.Fatal("changing the relative lock did not change the ID")
+	}
+}
+
+// Legacy IDs concatenate fields without separators so "a1" paid 23 and "a12" paid 3 hash the same. Canonical IDs
+// length prefix every field.
+func TestTxnIDFieldBoundaryCollision(t *testing.T) {
+	newTxn := func(version int, address string, amount int64, txnOutID string, txnOutIndex int64) *Transaction {
+		txn := &Transaction{Version: version, TxnOut: []*TxnOut{{Address: address, Amount: amount}}}
+		txn.TxnIn.Append(&TxnIn{TxnOutID: txnOutID, TxnOutIndex: txnOutIndex})
+		return txn
+	}
+
+	tests := []struct {
+		name string
+		a, b func(version int) *Transaction
+	}{
+		{
+			name: "txn out",
+			a:    func(version int) *Transaction { return newTxn(version, "a1", 23, "in", 0) },
+			b:    func(version int) *Transaction { return newTxn(version, "a12", 3, "in", 0) },
+		},
+		{
+			name: "txn in",
+			a:    func(version int) *Transaction { return newTxn(version, "out", 1, "a1", 23) },
+			b:    func(version int) *Transaction { return newTxn(version, "out", 1, "a12", 3) },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if GetTransactionID(test.a(TxnVersionLegacy)) != GetTransactionID(test.b(TxnVersionLegacy)) {
+				t.Fatal("expected legacy IDs to collide")
+			}
+			for _, version := range []int{TxnVersionCanonical, CurrentTxnVersion} {
+				if a, b := GetTransactionID(test.a(version)), GetTransactionID(test.b(version)); a == b {
+					t.Fatalf("version %d IDs collided: %s", version, a)
+				}
+			}
+		})
+	}
+}
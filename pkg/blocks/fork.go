@@ -0,0 +1,253 @@
+package blocks
+
+import (
+	"log"
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+// MaxOrphanBlocks is the most blocks with an unknown parent that will be held at once.
+const MaxOrphanBlocks = 100
+
+var (
+	ErrBlockExists = errors.New("block is already known")
+	ErrOrphanBlock = errors.New("block's parent is not known")
+)
+
+// ChainEvent describes a change to the main chain. Disconnected blocks are ordered from the old tip backwards and
+// connected blocks from the fork point forwards.
+type ChainEvent struct {
+	Connected    []*Block
+	Disconnected []*Block
+}
+
+// ReorgDepth is the number of main chain blocks that were replaced by the change.
+func (e *ChainEvent) ReorgDepth() int {
+	return len(e.Disconnected)
+}
+
+// blockNode is a block that is known to be valid relative to its parent.
+type blockNode struct {
+	block  *Block
+	parent *blockNode
+	// work is the cumulative work of the chain ending in this block.
+	work *big.Int
+}
+
+// Subscribe returns a channel that receives an event whenever the main chain changes. Subscribers must keep reading
+// from the channel or changes to the chain will block.
+func (c *Blockchain) Subscribe() <-chan *ChainEvent {
+	c.Lock()
+	defer c.Unlock()
+
+	ch := make(chan *ChainEvent, 100)
+	c.subscribers = append(c.subscribers, ch)
+	return ch
+}
+
+func (c *Blockchain) notify(events []*ChainEvent) {
+	c.RLock()
+	subscribers := c.subscribers
+	c.RUnlock()
+
+	for _, ev := range events {
+		for _, sub := range subscribers {
+			sub <- ev
+		}
+	}
+}
+
+// indexMainChain resets the known blocks to just those on the main chain.
+func (c *Blockchain) indexMainChain() {
+	c.nodes = make(map[string]*blockNode, len(c.Blocks))
+	c.orphans = make(map[string]*Block)
+
+	var parent *blockNode
+	for _, b := range c.Blocks {
+		node := &blockNode{block: b, parent: parent, work: blockWork(b)}
+		if parent != nil {
+			node.work.Add(node.work, parent.work)
+		}
+		c.nodes[b.Hash] = node
+		parent = node
+	}
+}
+
+// addBlock adds the block and then any orphans that were waiting for it. Must be called with the write lock held.
+func (c *Blockchain) addBlock(block *Block) ([]*ChainEvent, error) {
+	if block == nil {
+		return nil, errors.New("block was nil")
+	}
+	if _, found := c.nodes[block.Hash]; found {
+		return nil, ErrBlockExists
+	}
+	if _, found := c.orphans[block.Hash]; found {
+		return nil, ErrBlockExists
+	}
+	if _, found := c.nodes[block.PrevHash]; !found {
+		c.addOrphan(block)
+		return nil, ErrOrphanBlock
+	}
+
+	events := []*ChainEvent{}
+	ev, err := c.attach(block)
+	if err != nil {
+		return nil, err
+	}
+	if ev != nil {
+		events = append(events, ev)
+	}
+
+	queue := []string{block.Hash}
+	for len(queue) > 0 {
+		parentHash := queue[0]
+		queue = queue[1:]
+		for hash, orphan := range c.orphans {
+			if orphan.PrevHash != parentHash {
+				continue
+			}
+			delete(c.orphans, hash)
+			ev, err := c.attach(orphan)
+			if err != nil {
+				log.Printf("discarding orphan block %d (%s): %s", orphan.Index, orphan.Hash, err.Error())
+				continue
+			}
+			if ev != nil {
+				events = append(events, ev)
+			}
+			queue = append(queue, orphan.Hash)
+		}
+	}
+	return events, nil
+}
+
+func (c *Blockchain) addOrphan(block *Block) {
+	if len(c.orphans) >= MaxOrphanBlocks {
+		for hash := range c.orphans {
+			delete(c.orphans, hash)
+			break
+		}
+	}
+	c.orphans[block.Hash] = block
+}
+
+// attach adds a block whose parent is known. The returned event is nil if the block was added to a side chain.
+func (c *Blockchain) attach(block *Block) (*ChainEvent, error) {
+	parent := c.nodes[block.PrevHash]
+	if err := IsValidBlock(block, parent.block); err != nil {
+		return nil, err
+	}
+	if err := validateBlockBits(block, parent); err != nil {
+		return nil, err
+	}
+	node := &blockNode{block: block, parent: parent, work: new(big.Int).Add(parent.work, blockWork(block))}
+	tip := c.nodes[c.Blocks[len(c.Blocks)-1].Hash]
+
+	if parent == tip {
+		delta, err := ProcessTransactions(block, c.unspent)
+		if err != nil {
+			return nil, errors.Wrap(err, "block contained invalid transactions")
+		}
+		if c.store != nil {
+			if err := c.store.Append(block); err != nil {
+				c.unspent.Rollback(delta)
+				return nil, errors.Wrap(err, "failed to store block")
+			}
+		}
+		c.nodes[block.Hash] = node
+		c.Blocks = append(c.Blocks, block)
+		c.deltas = append(c.deltas, delta)
+		return &ChainEvent{Connected: []*Block{block}}, nil
+	}
+
+	c.nodes[block.Hash] = node
+	if node.work.Cmp(tip.work) <= 0 {
+		log.Printf("added block %d (%s) to side chain", block.Index, block.Hash)
+		return nil, nil
+	}
+	return c.reorganise(node)
+}
+
+// reorganise switches the main chain to the branch ending in newTip. If any block in the branch turns out to be
+// invalid the main chain is left as it was and the invalid blocks are forgotten.
+func (c *Blockchain) reorganise(newTip *blockNode) (*ChainEvent, error) {
+	branch := []*blockNode{}
+	fork := newTip
+	for !c.onMainChain(fork) {
+		branch = append([]*blockNode{fork}, branch...)
+		fork = fork.parent
+	}
+	forkIndex := fork.block.Index
+
+	disconnected := []*Block{}
+	for k := int64(len(c.Blocks)) - 1; k > forkIndex; k-- {
+		c.unspent.Rollback(c.deltas[k])
+		disconnected = append(disconnected, c.Blocks[k])
+	}
+
+	connected := []*Block{}
+	deltas := []*TxnOutUnspentDelta{}
+	for k, node := range branch {
+		delta, err := ProcessTransactions(node.block, c.unspent)
+		if err != nil {
+			c.restoreMainChain(forkIndex, deltas)
+			for _, invalid := range branch[k:] {
+				delete(c.nodes, invalid.block.Hash)
+			}
+			return nil, errors.Wrapf(err, "reorg aborted: block %d contained invalid transactions", node.block.Index)
+		}
+		connected = append(connected, node.block)
+		deltas = append(deltas, delta)
+	}
+
+	if c.store != nil {
+		if err := c.storeFrom(forkIndex+1, connected); err != nil {
+			c.restoreMainChain(forkIndex, deltas)
+			if restoreErr := c.storeFrom(forkIndex+1, c.Blocks[forkIndex+1:]); restoreErr != nil {
+				log.Printf("failed to restore stored chain after failed reorg: %s", restoreErr.Error())
+			}
+			return nil, errors.Wrap(err, "failed to store reorganised chain")
+		}
+	}
+
+	c.Blocks = append(c.Blocks[:forkIndex+1:forkIndex+1], connected...)
+	c.deltas = append(c.deltas[:forkIndex+1:forkIndex+1], deltas...)
+
+	log.Printf(
+		"chain reorganised at block %d: depth %d, new tip %d (%s)",
+		forkIndex,
+		len(disconnected),
+		newTip.block.Index,
+		newTip.block.Hash,
+	)
+	return &ChainEvent{Connected: connected, Disconnected: disconnected}, nil
+}
+
+// restoreMainChain undoes a partially applied branch and re-applies the main chain blocks after the fork.
+func (c *Blockchain) restoreMainChain(forkIndex int64, branchDeltas []*TxnOutUnspentDelta) {
+	for k := len(branchDeltas) - 1; k >= 0; k-- {
+		c.unspent.Rollback(branchDeltas[k])
+	}
+	for k := forkIndex + 1; k < int64(len(c.Blocks)); k++ {
+		c.deltas[k] = c.unspent.Apply(c.Blocks[k].Data, c.Blocks[k].Index)
+	}
+}
+
+// storeFrom replaces all stored blocks from the given index onwards.
+func (c *Blockchain) storeFrom(index int64, blocks []*Block) error {
+	if err := c.store.Truncate(index); err != nil {
+		return err
+	}
+	for _, b := range blocks {
+		if err := c.store.Append(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Blockchain) onMainChain(node *blockNode) bool {
+	index := node.block.Index
+	return index >= 0 && index < int64(len(c.Blocks)) && c.Blocks[index].Hash == node.block.Hash
+}
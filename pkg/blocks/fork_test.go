@@ -0,0 +1,265 @@
+package blocks
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memStore is an in memory Store. Appending the block with hash failHash fails.
+type memStore struct {
+	blocks   []*Block
+	failHash string
+}
+
+func (s *memStore) Load() ([]*Block, error) {
+	return append([]*Block{}, s.blocks...), nil
+}
+
+func (s *memStore) Append(block *Block) error {
+	if block.Hash == s.failHash {
+		return fmt.Errorf("store failed")
+	}
+	s.blocks = append(s.blocks, block)
+	return nil
+}
+
+func (s *memStore) Truncate(index int64) error {
+	if index < int64(len(s.blocks)) {
+		s.blocks = s.blocks[:index]
+	}
+	return nil
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
+
+func testChain(t *testing.T) (*Blockchain, *memStore) {
+	store := &memStore{}
+	chain, err := LoadBlockchain(store)
+	if err != nil {
+		t.Fatalf("failed to load chain: %s", err)
+	}
+	return chain, store
+}
+
+// mineTestBlock mines a block after parent paying the coinbase to the testAddress of miner. Branches must be kept
+// shorter than DifficultyAdjustmentInterval so the bits never change.
+func mineTestBlock(t *testing.T, parent *Block, miner string, txns ...*Transaction) *Block {
+	index := parent.Index + 1
+	txns = append([]*Transaction{NewCoinbaseTransaction(testAddress(miner), index, 0)}, txns...)
+	block := &Block{
+		BlockHeader: BlockHeader{
+			Version:    CurrentBlockVersion,
+			Index:      index,
+			PrevHash:   parent.Hash,
+			MerkleRoot: TxnMerkleRoot(CurrentBlockVersion, txns),
+			Timestamp:  time.Now(),
+			Bits:       TargetToCompact(blockTarget(parent)),
+		},
+		Data: txns,
+	}
+	if err := FindNonce(block); err != nil {
+		t.Fatalf("failed to mine block: %s", err)
+	}
+	return block
+}
+
+// mineTestBranch mines n blocks on top of parent.
+func mineTestBranch(t *testing.T, parent *Block, miner string, n int) []*Block {
+	branch := []*Block{}
+	for k := 0; k < n; k++ {
+		parent = mineTestBlock(t, parent, miner)
+		branch = append(branch, parent)
+	}
+	return branch
+}
+
+func appendBlocks(t *testing.T, chain *Blockchain, blocks ...*Block) {
+	for _, b := range blocks {
+		if err := chain.Append(b); err != nil {
+			t.Fatalf("failed to append block %d: %s", b.Index, err)
+		}
+	}
+}
+
+func blockHashes(blocks []*Block) []string {
+	hashes := make([]string, len(blocks))
+	for k, b := range blocks {
+		hashes[k] = b.Hash
+	}
+	return hashes
+}
+
+func assertMainChain(t *testing.T, chain *Blockchain, store *memStore, expected ...*Block) {
+	t.Helper()
+	want := blockHashes(append([]*Block{Genesis}, expected...))
+	if got := blockHashes(chain.Blocks); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected main chain %v got %v", want, got)
+	}
+	if got := blockHashes(store.blocks); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected stored chain %v got %v", want, got)
+	}
+}
+
+func TestReorgSwitchesTip(t *testing.T) {
+	chain, store := testChain(t)
+	events := chain.Subscribe()
+
+	main := mineTestBranch(t, Genesis, "main", 2)
+	branch := mineTestBranch(t, Genesis, "branch", 3)
+
+	appendBlocks(t, chain, main...)
+	appendBlocks(t, chain, branch[:2]...)
+	// the branch has the same work as the main chain so is kept as a side chain
+	assertMainChain(t, chain, store, main...)
+
+	appendBlocks(t, chain, branch[2])
+	assertMainChain(t, chain, store, branch...)
+
+	chain.ReadUnspent(func(unspent *TxnOutUnspentSet) error {
+		if got := unspent.ForAddress(testAddress("main")); len(got) != 0 {
+			t.Errorf("expected main chain coinbase outs to be removed, got %d", len(got))
+		}
+		if got := unspent.ForAddress(testAddress("branch")); len(got) != 3 {
+			t.Errorf("expected 3 branch coinbase outs, got %d", len(got))
+		}
+		return nil
+	})
+
+	for _, b := range main {
+		if ev := <-events; len(ev.Connected) != 1 || ev.Connected[0].Hash != b.Hash {
+			t.Fatalf("expected main chain block %d to be connected", b.Index)
+		}
+	}
+	reorg := <-events
+	if got, want := blockHashes(reorg.Disconnected), []string{main[1].Hash, main[0].Hash}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected disconnected %v got %v", want, got)
+	}
+	if got, want := blockHashes(reorg.Connected), blockHashes(branch); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected connected %v got %v", want, got)
+	}
+	if reorg.ReorgDepth() != 2 {
+		t.Fatalf("expected reorg depth 2 got %d", reorg.ReorgDepth())
+	}
+
+	// the old main chain can become the main chain again
+	appendBlocks(t, chain, mineTestBranch(t, main[1], "main", 2)...)
+	if got := chain.Last().Index; got != 4 {
+		t.Fatalf("expected to reorg back to the old main chain, tip was %d", got)
+	}
+}
+
+func TestReorgAbortedByInvalidBlock(t *testing.T) {
+	chain, store := testChain(t)
+
+	main := mineTestBranch(t, Genesis, "main", 2)
+	appendBlocks(t, chain, main...)
+	before := chain.unspent.All()
+
+	invalid := &Transaction{Version: CurrentTxnVersion, TxnOut: []*TxnOut{{Address: testAddress("branch"), Amount: 1}}}
+	invalid.TxnIn.Append(&TxnIn{TxnOutID: "missing", TxnOutIndex: 0})
+	invalid.ID = GetTransactionID(invalid)
+
+	branch := mineTestBranch(t, Genesis, "branch", 2)
+	branch = append(branch, mineTestBlock(t, branch[1], "branch", invalid))
+	appendBlocks(t, chain, branch[:2]...)
+
+	err := chain.Append(branch[2])
+	if err == nil || !strings.Contains(err.Error(), "reorg aborted") {
+		t.Fatalf("expected reorg to be aborted, got %v", err)
+	}
+	assertMainChain(t, chain, store, main...)
+	if !reflect.DeepEqual(chain.unspent.All(), before) {
+		t.Fatal("unspent set was not restored")
+	}
+	if chain.HasBlock(branch[2].Hash) {
+		t.Fatal("invalid block was kept")
+	}
+	if !chain.HasBlock(branch[1].Hash) {
+		t.Fatal("valid side chain block was forgotten")
+	}
+
+	// the valid part of the branch can still be extended
+	appendBlocks(t, chain, mineTestBlock(t, branch[1], "branch"))
+	if got := chain.Last().PrevHash; got != branch[1].Hash {
+		t.Fatal("expected to reorg onto the valid part of the branch")
+	}
+}
+
+func TestReorgAbortedByStoreFailure(t *testing.T) {
+	chain, store := testChain(t)
+
+	main := mineTestBranch(t, Genesis, "main", 2)
+	appendBlocks(t, chain, main...)
+	before := chain.unspent.All()
+
+	branch := mineTestBranch(t, Genesis, "branch", 3)
+	appendBlocks(t, chain, branch[:2]...)
+
+	store.failHash = branch[1].Hash
+	err := chain.Append(branch[2])
+	if err == nil || !strings.Contains(err.Error(), "failed to store reorganised chain") {
+		t.Fatalf("expected reorg to fail storing, got %v", err)
+	}
+	assertMainChain(t, chain, store, main...)
+	if !reflect.DeepEqual(chain.unspent.All(), before) {
+		t.Fatal("unspent set was not restored")
+	}
+}
+
+func TestOrphanAttachment(t *testing.T) {
+	chain, store := testChain(t)
+	events := chain.Subscribe()
+
+	blocks := mineTestBranch(t, Genesis, "main", 3)
+
+	for _, b := range []*Block{blocks[2], blocks[1]} {
+		if err := chain.Append(b); err != ErrOrphanBlock {
+			t.Fatalf("expected block %d to be an orphan, got %v", b.Index, err)
+		}
+		if !chain.HasBlock(b.Hash) {
+			t.Fatalf("orphan block %d was not kept", b.Index)
+		}
+	}
+	if err := chain.Append(blocks[2]); err != ErrBlockExists {
+		t.Fatalf("expected known orphan to be rejected, got %v", err)
+	}
+	assertMainChain(t, chain, store)
+
+	appendBlocks(t, chain, blocks[0])
+	assertMainChain(t, chain, store, blocks...)
+	if len(chain.orphans) != 0 {
+		t.Fatalf("expected all orphans to be attached, %d left", len(chain.orphans))
+	}
+	for _, b := range blocks {
+		if ev := <-events; len(ev.Connected) != 1 || ev.Connected[0].Hash != b.Hash {
+			t.Fatalf("expected block %d to be connected", b.Index)
+		}
+	}
+}
+
+func TestInvalidOrphanIsDiscarded(t *testing.T) {
+	chain, store := testChain(t)
+
+	blocks := mineTestBranch(t, Genesis, "main", 2)
+	// the coinbase claims a fee that was never paid
+	bad := *blocks[1]
+	bad.Data = []*Transaction{NewCoinbaseTransaction(testAddress("main"), bad.Index, 1)}
+	bad.MerkleRoot = TxnMerkleRoot(bad.Version, bad.Data)
+	if err := FindNonce(&bad); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := chain.Append(&bad); err != ErrOrphanBlock {
+		t.Fatalf("expected orphan, got %v", err)
+	}
+	appendBlocks(t, chain, blocks[0])
+	assertMainChain(t, chain, store, blocks[0])
+	if chain.HasBlock(bad.Hash) {
+		t.Fatal("invalid orphan was kept")
+	}
+}
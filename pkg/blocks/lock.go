@@ -0,0 +1,439 @@
+package blocks
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/warmans/catbux/pkg/crypto"
+)
+
+// Limits on locking conditions to keep evaluation cheap.
+const (
+	MaxLockSize     = 4096
+	MaxLockDepth    = 8
+	MaxMultiSigKeys = 16
+)
+
+// Lock is a locking condition that must be satisfied to spend a txn out. Conditions are written as text e.g.
+//
+//	pubkey(KEY)                   a signature by KEY
+//	multi(M,KEY1,KEY2...)         signatures by at least M of the keys
+//	hash(SHA256)                  a preimage of the hex encoded SHA-256 digest
+//	after(LOCKTIME)               the block is at or after LOCKTIME (a height or unix time as per LockTimeThreshold)
+//	and(COND1,COND2...)           all of the conditions
+//	or(COND1,COND2...)            any of the conditions
+//
+// Keys are base64 encoded public keys (the same as addresses). Only the canonical text of a condition (as returned by
+// String) is accepted in a txn out.
+type Lock interface {
+	String() string
+	satisfied(ctx *lockContext) bool
+}
+
+// Witness holds the data used to satisfy the lock of the txn out spent by a txn in. Signatures are base64 encoded
+// signatures of the txn in's SignatureHash and preimages are hex encoded.
+type Witness struct {
+	Signatures []string `json:"signatures,omitempty"`
+	Preimages  []string `json:"preimages,omitempty"`
+}
+
+// empty reports whether the witness holds no signatures or preimages. An empty witness is encoded the same as no
+// witness so the two are treated alike.
+func (w *Witness) empty() bool {
+	return w == nil || (len(w.Signatures) == 0 && len(w.Preimages) == 0)
+}
+
+// PubKeyLock requires a signature by the key.
+func PubKeyLock(key string) Lock {
+	return &pubKeyLock{key: key}
+}
+
+// MultiSigLock requires signatures by at least m of the keys.
+func MultiSigLock(m int, keys ...string) Lock {
+	return &multiSigLock{m: m, keys: keys}
+}
+
+// HashLock requires a preimage of the SHA-256 digest.
+func HashLock(digest []byte) Lock {
+	return &hashLock{digest: digest}
+}
+
+// TimeLock requires the spending block to be at or after the lock time.
+func TimeLock(lockTime int64) Lock {
+	return &timeLock{lockTime: lockTime}
+}
+
+// AndLock requires all of the conditions.
+func AndLock(conds ...Lock) Lock {
+	return &andLock{conds: conds}
+}
+
+// OrLock requires any of the conditions.
+func OrLock(conds ...Lock) Lock {
+	return &orLock{conds: conds}
+}
+
+// LockAddress is the address of txn outs locked by the condition: the base64 encoded SHA-256 digest of its text.
+func LockAddress(lock Lock) string {
+	digest := sha256.Sum256([]byte(lock.String()))
+	return base64.URLEncoding.EncodeToString(digest[:])
+}
+
+// LockKeys returns every key that can sign for the lock (whether or not its signature alone is enough).
+func LockKeys(lock Lock) []string {
+	switch l := lock.(type) {
+	case *pubKeyLock:
+		return []string{l.key}
+	case *multiSigLock:
+		return append([]string{}, l.keys...)
+	case *andLock:
+		return lockKeys(l.conds)
+	case *orLock:
+		return lockKeys(l.conds)
+	default:
+		return nil
+	}
+}
+
+func lockKeys(conds []Lock) []string {
+	keys := []string{}
+	for _, c := range conds {
+		keys = append(keys, LockKeys(c)...)
+	}
+	return keys
+}
+
+// lockHashes counts the hash conditions within the lock.
+func lockHashes(lock Lock) int {
+	switch l := lock.(type) {
+	case *hashLock:
+		return 1
+	case *andLock:
+		return lockHashesOf(l.conds)
+	case *orLock:
+		return lockHashesOf(l.conds)
+	default:
+		return 0
+	}
+}
+
+func lockHashesOf(conds []Lock) int {
+	n := 0
+	for _, c := range conds {
+		n += lockHashes(c)
+	}
+	return n
+}
+
+// validateWitnessSize checks the witness holds no more signatures than the lock has keys and no more preimages than
+// it has hash conditions, so the work of evaluating the lock is bounded by the lock itself.
+func validateWitnessSize(lock Lock, witness *Witness) error {
+	if witness == nil {
+		return nil
+	}
+	if keys := len(LockKeys(lock)); len(witness.Signatures) > keys {
+		return fmt.Errorf("witness had %d signatures but the lock has %d keys", len(witness.Signatures), keys)
+	}
+	if hashes := lockHashes(lock); len(witness.Preimages) > hashes {
+		return fmt.Errorf("witness had %d preimages but the lock has %d hash conditions", len(witness.Preimages), hashes)
+	}
+	return nil
+}
+
+// ParseLock parses the text of a locking condition. The text must be in canonical form.
+func ParseLock(text string) (Lock, error) {
+	if len(text) > MaxLockSize {
+		return nil, fmt.Errorf("lock of %d bytes exceeded the maximum size", len(text))
+	}
+	p := &lockParser{text: text}
+	lock, err := p.parse(0)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid lock")
+	}
+	if p.pos != len(text) {
+		return nil, fmt.Errorf("invalid lock: unexpected text at %d", p.pos)
+	}
+	if lock.String() != text {
+		return nil, fmt.Errorf("invalid lock: not in canonical form (expected %s)", lock.String())
+	}
+	return lock, nil
+}
+
+// lockContext is the data a lock is evaluated against. If checkTime is false time locks are assumed to be satisfied
+// so that the rest of the condition can be checked before the spending block is known.
+type lockContext struct {
+	sigHash    []byte
+	signatures [][]byte
+	preimages  [][]byte
+	checkTime  bool
+	blockIndex int64
+	blockTime  time.Time
+}
+
+func newLockContext(witness *Witness, sigHash []byte) (*lockContext, error) {
+	ctx := &lockContext{sigHash: sigHash}
+	if witness == nil {
+		return ctx, nil
+	}
+	for _, sig := range witness.Signatures {
+		decoded, err := base64.URLEncoding.DecodeString(sig)
+		if err != nil {
+			return nil, errors.Wrap(err, "witness signature was not valid base64")
+		}
+		ctx.signatures = append(ctx.signatures, decoded)
+	}
+	for _, preimage := range witness.Preimages {
+		decoded, err := hex.DecodeString(preimage)
+		if err != nil {
+			return nil, errors.Wrap(err, "witness preimage was not valid hex")
+		}
+		ctx.preimages = append(ctx.preimages, decoded)
+	}
+	return ctx, nil
+}
+
+func (ctx *lockContext) signedBy(key *ecdsa.PublicKey) bool {
+	for _, sig := range ctx.signatures {
+		if crypto.Verify(ctx.sigHash, sig, key) {
+			return true
+		}
+	}
+	return false
+}
+
+type pubKeyLock struct {
+	key string
+	pub *ecdsa.PublicKey
+}
+
+func (l *pubKeyLock) String() string {
+	return "pubkey(" + l.key + ")"
+}
+
+func (l *pubKeyLock) satisfied(ctx *lockContext) bool {
+	return l.pub != nil && ctx.signedBy(l.pub)
+}
+
+type multiSigLock struct {
+	m    int
+	keys []string
+	pubs []*ecdsa.PublicKey
+}
+
+func (l *multiSigLock) String() string {
+	return "multi(" + strconv.Itoa(l.m) + "," + strings.Join(l.keys, ",") + ")"
+}
+
+func (l *multiSigLock) satisfied(ctx *lockContext) bool {
+	signed := 0
+	for _, pub := range l.pubs {
+		if ctx.signedBy(pub) {
+			signed++
+		}
+	}
+	return l.m > 0 && signed >= l.m
+}
+
+type hashLock struct {
+	digest []byte
+}
+
+func (l *hashLock) String() string {
+	return "hash(" + hex.EncodeToString(l.digest) + ")"
+}
+
+func (l *hashLock) satisfied(ctx *lockContext) bool {
+	for _, preimage := range ctx.preimages {
+		if digest := sha256.Sum256(preimage); bytes.Equal(digest[:], l.digest) {
+			return true
+		}
+	}
+	return false
+}
+
+type timeLock struct {
+	lockTime int64
+}
+
+func (l *timeLock) String() string {
+	return "after(" + strconv.FormatInt(l.lockTime, 10) + ")"
+}
+
+func (l *timeLock) satisfied(ctx *lockContext) bool {
+	if !ctx.checkTime {
+		return true
+	}
+	return (&Transaction{LockTime: l.lockTime}).IsFinal(ctx.blockIndex, ctx.blockTime)
+}
+
+type andLock struct {
+	conds []Lock
+}
+
+func (l *andLock) String() string {
+	return "and(" + joinLocks(l.conds) + ")"
+}
+
+func (l *andLock) satisfied(ctx *lockContext) bool {
+	for _, c := range l.conds {
+		if !c.satisfied(ctx) {
+			return false
+		}
+	}
+	return true
+}
+
+type orLock struct {
+	conds []Lock
+}
+
+func (l *orLock) String() string {
+	return "or(" + joinLocks(l.conds) + ")"
+}
+
+func (l *orLock) satisfied(ctx *lockContext) bool {
+	for _, c := range l.conds {
+		if c.satisfied(ctx) {
+			return true
+		}
+	}
+	return false
+}
+
+func joinLocks(conds []Lock) string {
+	parts := make([]string, len(conds))
+	for k, c := range conds {
+		parts[k] = c.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+type lockParser struct {
+	text string
+	pos  int
+}
+
+// parse reads a single condition.
+func (p *lockParser) parse(depth int) (Lock, error) {
+	if depth >= MaxLockDepth {
+		return nil, fmt.Errorf("conditions were nested more than %d deep", MaxLockDepth)
+	}
+	open := strings.IndexByte(p.text[p.pos:], '(')
+	if open == -1 {
+		return nil, fmt.Errorf("expected condition at %d", p.pos)
+	}
+	name := p.text[p.pos : p.pos+open]
+	p.pos += open + 1
+
+	switch name {
+	case "and", "or":
+		conds := []Lock{}
+		for {
+			c, err := p.parse(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			conds = append(conds, c)
+			if !p.consume(',') {
+				break
+			}
+		}
+		if !p.consume(')') {
+			return nil, fmt.Errorf("expected ) at %d", p.pos)
+		}
+		if len(conds) < 2 {
+			return nil, fmt.Errorf("%s requires at least two conditions", name)
+		}
+		if name == "and" {
+			return &andLock{conds: conds}, nil
+		}
+		return &orLock{conds: conds}, nil
+	}
+
+	end := strings.IndexByte(p.text[p.pos:], ')')
+	if end == -1 {
+		return nil, fmt.Errorf("expected ) after %s", name)
+	}
+	args := strings.Split(p.text[p.pos:p.pos+end], ",")
+	p.pos += end + 1
+
+	switch name {
+	case "pubkey":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("pubkey requires one key")
+		}
+		pub, err := parseLockKey(args[0])
+		if err != nil {
+			return nil, errors.Wrap(err, "pubkey key was invalid")
+		}
+		return &pubKeyLock{key: args[0], pub: pub}, nil
+	case "multi":
+		m, err := strconv.Atoi(args[0])
+		if err != nil {
+			return nil, fmt.Errorf("multi threshold was not a number: %s", args[0])
+		}
+		keys := args[1:]
+		if len(keys) == 0 || len(keys) > MaxMultiSigKeys {
+			return nil, fmt.Errorf("multi requires between 1 and %d keys", MaxMultiSigKeys)
+		}
+		if m < 1 || m > len(keys) {
+			return nil, fmt.Errorf("multi threshold must be between 1 and %d", len(keys))
+		}
+		seen := make(map[string]struct{}, len(keys))
+		pubs := make([]*ecdsa.PublicKey, len(keys))
+		for k, key := range keys {
+			if pubs[k], err = parseLockKey(key); err != nil {
+				return nil, errors.Wrapf(err, "multi key %d was invalid", k)
+			}
+			// keys are canonical so the same key cannot appear under two encodings
+			if _, found := seen[key]; found {
+				return nil, fmt.Errorf("multi key %d was repeated", k)
+			}
+			seen[key] = struct{}{}
+		}
+		return &multiSigLock{m: m, keys: keys, pubs: pubs}, nil
+	case "hash":
+		digest, err := hex.DecodeString(args[0])
+		if len(args) != 1 || err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("hash requires a hex encoded SHA-256 digest")
+		}
+		return &hashLock{digest: digest}, nil
+	case "after":
+		lockTime, err := strconv.ParseInt(args[0], 10, 64)
+		if len(args) != 1 || err != nil || lockTime < 0 {
+			return nil, fmt.Errorf("after requires a lock time")
+		}
+		return &timeLock{lockTime: lockTime}, nil
+	default:
+		return nil, fmt.Errorf("unknown condition %s", name)
+	}
+}
+
+// parseLockKey decodes a key in lock text. The key must be exactly as encoded by PubKeyToBase64 so that each key has
+// only one valid encoding.
+func parseLockKey(key string) (*ecdsa.PublicKey, error) {
+	pub, err := crypto.PubKeyFromBase64(key)
+	if err != nil {
+		return nil, err
+	}
+	if canonical, err := crypto.PubKeyToBase64(pub); err != nil || canonical != key {
+		return nil, fmt.Errorf("key was not in canonical form")
+	}
+	return pub, nil
+}
+
+func (p *lockParser) consume(c byte) bool {
+	if p.pos < len(p.text) && p.text[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
@@ -0,0 +1,323 @@
+package blocks
+
+import (
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/pem"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/warmans/catbux/pkg/crypto"
+)
+
+// testLockKeys creates n keys and their base64 public keys for use in lock text.
+func testLockKeys(t *testing.T, n int) ([]*ecdsa.PrivateKey, []string) {
+	keys := make([]*ecdsa.PrivateKey, n)
+	pubs := make([]string, n)
+	for k := range keys {
+		keys[k] = testKey(t)
+		pub, err := crypto.PubKeyToBase64(&keys[k].PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pubs[k] = pub
+	}
+	return keys, pubs
+}
+
+// testLockedTxn creates an unsigned transaction spending a single txn out locked by the lock text.
+func testLockedTxn(t *testing.T, lockText string) (*Transaction, *TxnOutUnspentSet) {
+	lock, err := ParseLock(lockText)
+	if err != nil {
+		t.Fatalf("failed to parse lock: %s", err)
+	}
+	unspent := NewTxnOutUnspentSet()
+	unspent.Add(&TxnOutUnspent{TxnOutID: "locked", TxnOutIndex: 0, Address: LockAddress(lock), Amount: 10, Lock: lockText})
+
+	txn := &Transaction{Version: CurrentTxnVersion, TxnOut: []*TxnOut{{Address: testAddress("receiver"), Amount: 9}}}
+	txn.TxnIn.Append(&TxnIn{TxnOutID: "locked", TxnOutIndex: 0})
+	txn.ID = GetTransactionID(txn)
+	return txn, unspent
+}
+
+func lockSignatures(t *testing.T, txn *Transaction, unspent *TxnOutUnspentSet, keys ...*ecdsa.PrivateKey) []string {
+	sigs := []string{}
+	for _, key := range keys {
+		sig, err := SignTxnInLock(txn, 0, key, unspent)
+		if err != nil {
+			t.Fatalf("failed to sign: %s", err)
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs
+}
+
+func TestValidateLockRejectsOversizedWitness(t *testing.T) {
+	keys, pubs := testLockKeys(t, 2)
+	digest := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" // sha256("hello")
+	lockText := "or(multi(1," + pubs[0] + "," + pubs[1] + "),hash(" + digest + "))"
+
+	tests := []struct {
+		name      string
+		witness   func(txn *Transaction, unspent *TxnOutUnspentSet) *Witness
+		err       string
+		satisfied bool
+	}{
+		{
+			name: "one signature per key",
+			witness: func(txn *Transaction, unspent *TxnOutUnspentSet) *Witness {
+				return &Witness{Signatures: lockSignatures(t, txn, unspent, keys[0], keys[1])}
+			},
+			satisfied: true,
+		},
+		{
+			name: "more signatures than keys",
+			witness: func(txn *Transaction, unspent *TxnOutUnspentSet) *Witness {
+				return &Witness{Signatures: lockSignatures(t, txn, unspent, keys[0], keys[1], keys[0])}
+			},
+			err: "witness had 3 signatures but the lock has 2 keys",
+		},
+		{
+			name: "one preimage per hash",
+			witness: func(txn *Transaction, unspent *TxnOutUnspentSet) *Witness {
+				return &Witness{Preimages: []string{"68656c6c6f"}}
+			},
+			satisfied: true,
+		},
+		{
+			name: "more preimages than hashes",
+			witness: func(txn *Transaction, unspent *TxnOutUnspentSet) *Witness {
+				return &Witness{Preimages: []string{"00", "68656c6c6f"}}
+			},
+			err: "witness had 2 preimages but the lock has 1 hash conditions",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			txn, unspent := testLockedTxn(t, lockText)
+			in, _ := txn.GetTxnIn(0)
+			in.Witness = test.witness(txn, unspent)
+
+			err := txn.Validate(unspent)
+			if test.satisfied {
+				if err != nil {
+					t.Fatalf("expected witness to satisfy lock: %s", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q got %v", test.err, err)
+			}
+		})
+	}
+}
+
+// An empty witness is encoded the same as no witness so JSON and binary decoding must agree on whether it is valid.
+func TestEmptyWitnessIsTreatedAsNil(t *testing.T) {
+	for _, version := range []int{TxnVersionLockTime, CurrentTxnVersion} {
+		key := testKey(t)
+		address, err := crypto.PubKeyToBase64(&key.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		unspent := NewTxnOutUnspentSet()
+		unspent.Add(&TxnOutUnspent{TxnOutID: "funding", TxnOutIndex: 0, Address: address, Amount: 10})
+		txn := &Transaction{Version: version, TxnOut: []*TxnOut{{Address: testAddress("receiver"), Amount: 10}}}
+		txn.TxnIn.Append(&TxnIn{TxnOutID: "funding", TxnOutIndex: 0})
+		txn.ID = GetTransactionID(txn)
+		signAll(t, txn, unspent, key)
+
+		in, _ := txn.GetTxnIn(0)
+		in.Witness = &Witness{}
+		if err := txn.Validate(unspent); err != nil {
+			t.Fatalf("version %d: expected empty witness to be ignored: %s", version, err)
+		}
+
+		encoded, err := txn.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := &Transaction{}
+		if err := decoded.UnmarshalBinary(encoded); err != nil {
+			t.Fatal(err)
+		}
+		if err := decoded.Validate(unspent); err != nil {
+			t.Fatalf("version %d: expected decoded txn to be valid: %s", version, err)
+		}
+
+		in.Witness = &Witness{Preimages: []string{"00"}}
+		if err := txn.Validate(unspent); err == nil {
+			t.Fatalf("version %d: expected non-empty witness to be rejected", version)
+		}
+	}
+}
+
+// lockText replaces the placeholders {0}, {1}... with keys and {H} with the digest of "secret".
+func lockText(text string, keys []string) string {
+	for k, key := range keys {
+		text = strings.ReplaceAll(text, "{"+strconv.Itoa(k)+"}", key)
+	}
+	return strings.ReplaceAll(text, "{H}", "2bb80d537b1da3e38bd30361aa855686bde0eacd7162fef6a25fe97bf527a25b")
+}
+
+func nestedLock(depth int) string {
+	if depth == 0 {
+		return "after(1)"
+	}
+	return "and(" + nestedLock(depth-1) + ",after(2))"
+}
+
+// junkPrefixKey re-encodes the base64 key with text before the PEM block, which PEM decoding skips.
+func junkPrefixKey(t *testing.T, key string) string {
+	decoded, err := base64.URLEncoding.DecodeString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.URLEncoding.EncodeToString(append([]byte("junk\n"), decoded...))
+}
+
+func TestParseLock(t *testing.T) {
+	_, pubs := testLockKeys(t, MaxMultiSigKeys)
+
+	oversized := "or(after(0)"
+	for k := 1; len(oversized) < MaxLockSize; k++ {
+		oversized += ",after(" + strconv.Itoa(k) + ")"
+	}
+	oversized += ")"
+
+	tests := []struct {
+		name string
+		text string
+		err  string
+	}{
+		{name: "pubkey", text: "pubkey({0})"},
+		{name: "multi", text: "multi(2,{0},{1},{2})"},
+		{name: "multi with all keys required", text: "multi(3,{0},{1},{2})"},
+		{name: "hash", text: "hash({H})"},
+		{name: "after height", text: "after(100)"},
+		{name: "after time", text: "after(1600000000)"},
+		{name: "and", text: "and(pubkey({0}),after(100))"},
+		{name: "or of and", text: "or(multi(1,{0},{1}),and(hash({H}),after(5)))"},
+		{name: "max depth", text: nestedLock(MaxLockDepth - 1)},
+		{name: "multi max keys", text: "multi(1," + strings.Join(pubs[:MaxMultiSigKeys], ",") + ")"},
+
+		{name: "empty", text: "", err: "expected condition"},
+		{name: "unknown condition", text: "foo(1)", err: "unknown condition foo"},
+		{name: "missing close", text: "pubkey({0}", err: "expected )"},
+		{name: "trailing text", text: "after(1)x", err: "unexpected text"},
+		{name: "leading space", text: " after(1)", err: "unknown condition"},
+		{name: "space after comma", text: "and(after(1), after(2))", err: "unknown condition"},
+		{name: "invalid key", text: "pubkey(notakey)", err: "pubkey key was invalid"},
+		{name: "key not pem", text: "pubkey(AAAA)", err: "pubkey key was invalid"},
+		{name: "key not pem text", text: "pubkey(" + base64.URLEncoding.EncodeToString([]byte("not a key")) + ")", err: "pubkey key was invalid"},
+		{name: "key wrong pem type", text: "pubkey(" + base64.URLEncoding.EncodeToString(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{1}})) + ")", err: "pubkey key was invalid"},
+		{name: "multi key not pem", text: "multi(1,{0},AAAA)", err: "multi key 1 was invalid"},
+		{name: "key with junk prefix", text: "pubkey(" + junkPrefixKey(t, pubs[0]) + ")", err: "not in canonical form"},
+		{name: "multi repeated key with junk prefix", text: "multi(1,{0}," + junkPrefixKey(t, pubs[0]) + ")", err: "multi key 1 was invalid"},
+		{name: "key without padding", text: "pubkey(" + strings.TrimRight(pubs[0], "=") + ")", err: "pubkey key was invalid"},
+		{name: "pubkey with two keys", text: "pubkey({0},{1})", err: "pubkey requires one key"},
+		{name: "multi threshold zero", text: "multi(0,{0})", err: "threshold must be between 1 and 1"},
+		{name: "multi threshold above keys", text: "multi(3,{0},{1})", err: "threshold must be between 1 and 2"},
+		{name: "multi threshold not a number", text: "multi(x,{0})", err: "threshold was not a number"},
+		{name: "multi without keys", text: "multi(1)", err: "between 1 and 16 keys"},
+		{name: "multi repeated key", text: "multi(1,{0},{0})", err: "multi key 1 was repeated"},
+		{name: "multi leading zero", text: "multi(01,{0})", err: "not in canonical form"},
+		{name: "hash too short", text: "hash(abcd)", err: "SHA-256 digest"},
+		{name: "hash upper case", text: "hash(" + strings.ToUpper(lockText("{H}", nil)) + ")", err: "not in canonical form"},
+		{name: "after negative", text: "after(-1)", err: "requires a lock time"},
+		{name: "after not a number", text: "after(x)", err: "requires a lock time"},
+		{name: "after leading zero", text: "after(007)", err: "not in canonical form"},
+		{name: "and with one condition", text: "and(after(1))", err: "at least two conditions"},
+		{name: "or with one condition", text: "or(after(1))", err: "at least two conditions"},
+		{name: "too deep", text: nestedLock(MaxLockDepth), err: "nested more than 8 deep"},
+		{name: "too large", text: oversized, err: "exceeded the maximum size"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			text := lockText(test.text, pubs)
+			lock, err := ParseLock(text)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if lock.String() != text {
+				t.Fatalf("expected canonical text %s got %s", text, lock.String())
+			}
+		})
+	}
+}
+
+func TestLockSatisfied(t *testing.T) {
+	keys, pubs := testLockKeys(t, 3)
+	sigHash := []byte("sighash")
+	blockTime := time.Unix(1600000000, 0)
+
+	tests := []struct {
+		name       string
+		lock       string
+		signers    []int
+		preimages  []string
+		checkTime  bool
+		blockIndex int64
+		expected   bool
+	}{
+		{name: "pubkey signed", lock: "pubkey({0})", signers: []int{0}, expected: true},
+		{name: "pubkey signed by other key", lock: "pubkey({0})", signers: []int{1}},
+		{name: "pubkey unsigned", lock: "pubkey({0})"},
+
+		{name: "multi 2 of 3", lock: "multi(2,{0},{1},{2})", signers: []int{0, 2}, expected: true},
+		{name: "multi 3 of 3", lock: "multi(2,{0},{1},{2})", signers: []int{2, 1, 0}, expected: true},
+		{name: "multi 1 of 3", lock: "multi(2,{0},{1},{2})", signers: []int{1}},
+		{name: "multi same key twice", lock: "multi(2,{0},{1},{2})", signers: []int{1, 1}},
+
+		{name: "hash preimage", lock: "hash({H})", preimages: []string{"secret"}, expected: true},
+		{name: "hash wrong preimage", lock: "hash({H})", preimages: []string{"guess"}},
+		{name: "hash one of several preimages", lock: "hash({H})", preimages: []string{"guess", "secret"}, expected: true},
+
+		{name: "after unchecked", lock: "after(100)", expected: true},
+		{name: "after height reached", lock: "after(100)", checkTime: true, blockIndex: 100, expected: true},
+		{name: "after height not reached", lock: "after(100)", checkTime: true, blockIndex: 99},
+		{name: "after time reached", lock: "after(1600000000)", checkTime: true, expected: true},
+		{name: "after time not reached", lock: "after(1600000001)", checkTime: true, blockIndex: 1600000001},
+
+		{name: "and all satisfied", lock: "and(pubkey({0}),after(100))", signers: []int{0}, checkTime: true, blockIndex: 100, expected: true},
+		{name: "and one unsatisfied", lock: "and(pubkey({0}),after(100))", signers: []int{0}, checkTime: true, blockIndex: 99},
+		{name: "or first satisfied", lock: "or(pubkey({0}),hash({H}))", signers: []int{0}, expected: true},
+		{name: "or second satisfied", lock: "or(pubkey({0}),hash({H}))", preimages: []string{"secret"}, expected: true},
+		{name: "or none satisfied", lock: "or(pubkey({0}),hash({H}))", signers: []int{1}},
+
+		// escrow: both parties, or the arbiter with either party, or the buyer alone after a timeout
+		{name: "escrow both parties", lock: "or(multi(2,{0},{1},{2}),and(pubkey({0}),after(500)))", signers: []int{0, 1}, expected: true},
+		{name: "escrow buyer before timeout", lock: "or(multi(2,{0},{1},{2}),and(pubkey({0}),after(500)))", signers: []int{0}, checkTime: true, blockIndex: 499},
+		{name: "escrow buyer after timeout", lock: "or(multi(2,{0},{1},{2}),and(pubkey({0}),after(500)))", signers: []int{0}, checkTime: true, blockIndex: 500, expected: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lock, err := ParseLock(lockText(test.lock, pubs))
+			if err != nil {
+				t.Fatalf("failed to parse lock: %s", err)
+			}
+			ctx := &lockContext{sigHash: sigHash, checkTime: test.checkTime, blockIndex: test.blockIndex, blockTime: blockTime}
+			for _, k := range test.signers {
+				sig, err := crypto.Sign(sigHash, keys[k])
+				if err != nil {
+					t.Fatal(err)
+				}
+				ctx.signatures = append(ctx.signatures, sig)
+			}
+			for _, preimage := range test.preimages {
+				ctx.preimages = append(ctx.preimages, []byte(preimage))
+			}
+			if got := lock.satisfied(ctx); got != test.expected {
+				t.Fatalf("expected satisfied=%v got %v", test.expected, got)
+			}
+		})
+	}
+}
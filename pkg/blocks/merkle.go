@@ -0,0 +1,188 @@
+package blocks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Leaves and interior nodes are hashed with different prefixes so an interior node can never be passed off as a
+// leaf (or vice versa).
+const (
+	merkleLeafPrefix byte = 0x00
+	merkleNodePrefix byte = 0x01
+)
+
+// TxnMerkleRoot is the hex encoded root of the Merkle tree over the given transactions in a block of the given
+// version. From BlockVersionWitness each leaf commits to the transaction's ID and its TxnHash so the root covers
+// signatures and witnesses. Earlier leaves only commit to the ID.
+func TxnMerkleRoot(blockVersion int, txns []*Transaction) string {
+	return hex.EncodeToString(merkleRoot(txnMerkleLeaves(blockVersion, txns)))
+}
+
+// TxnHash is the hex encoded SHA-256 digest of the transaction's full canonical encoding including the signature and
+// witness of each txn in.
+func TxnHash(t *Transaction) string {
+	return hex.EncodeToString(txnHash(t))
+}
+
+func txnHash(t *Transaction) []byte {
+	hash := sha256.New()
+	e := &encoder{w: hash}
+	e.writeTxn(t, true)
+	return hash.Sum(nil)
+}
+
+// txnMerkleLeaves hashes each transaction into a leaf of the tree.
+func txnMerkleLeaves(blockVersion int, txns []*Transaction) [][]byte {
+	leaves := make([][]byte, len(txns))
+	for k, txn := range txns {
+		if blockVersion >= BlockVersionWitness {
+			leaves[k] = merkleLeaf(txn.ID, txnHash(txn))
+		} else {
+			leaves[k] = merkleLeaf(txn.ID, nil)
+		}
+	}
+	return leaves
+}
+
+// merkleRoot reduces the leaves to a single hash by hashing pairs of nodes at each level. An odd node at the end of
+// a level is carried up to the next level unchanged. The root of an empty tree is the hash of nothing.
+func merkleRoot(level [][]byte) []byte {
+	if len(level) == 0 {
+		empty := sha256.Sum256(nil)
+		return empty[:]
+	}
+	for len(level) > 1 {
+		level = nextMerkleLevel(level)
+	}
+	return level[0]
+}
+
+func nextMerkleLevel(level [][]byte) [][]byte {
+	next := make([][]byte, 0, (len(level)+1)/2)
+	for k := 0; k < len(level); k += 2 {
+		if k+1 == len(level) {
+			next = append(next, level[k])
+			continue
+		}
+		next = append(next, merkleNode(level[k], level[k+1]))
+	}
+	return next
+}
+
+// merkleLeaf hashes the txn ID followed by the digest of its full encoding (which is nil before BlockVersionWitness).
+// The digest is a fixed size so it cannot be confused with part of the ID.
+func merkleLeaf(id string, txnHash []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte{merkleLeafPrefix})
+	hash.Write([]byte(id))
+	hash.Write(txnHash)
+	return hash.Sum(nil)
+}
+
+func merkleNode(left, right []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte{merkleNodePrefix})
+	hash.Write(left)
+	hash.Write(right)
+	return hash.Sum(nil)
+}
+
+// MerkleProof shows a transaction is included in a block. Branch holds the hex encoded sibling of each node on the
+// path from the transaction's leaf to the root. Levels where the path node has no sibling (because it is carried up
+// unchanged) have no entry. TxnHash is the transaction's TxnHash for blocks from BlockVersionWitness; a client holding
+// the full transaction can compare it to check the signatures it has are the ones in the block.
+type MerkleProof struct {
+	Header    BlockHeader `json:"header"`
+	BlockHash string      `json:"block_hash"`
+	TxnID     string      `json:"txn_id"`
+	TxnHash   string      `json:"txn_hash,omitempty"`
+	Index     int         `json:"index"`
+	TxnCount  int         `json:"txn_count"`
+	Branch    []string    `json:"branch"`
+}
+
+// NewMerkleProof creates a proof that the block contains the transaction with the given ID.
+func NewMerkleProof(block *Block, txnID string) (*MerkleProof, error) {
+	if block.Version < BlockVersionHeader {
+		return nil, fmt.Errorf("block version %d does not commit to its transactions", block.Version)
+	}
+	index := -1
+	for k, txn := range block.Data {
+		if txn.ID == txnID {
+			index = k
+			break
+		}
+	}
+	if index == -1 {
+		return nil, fmt.Errorf("block %d does not contain txn %s", block.Index, txnID)
+	}
+
+	proof := &MerkleProof{
+		Header:    block.BlockHeader,
+		BlockHash: block.Hash,
+		TxnID:     txnID,
+		Index:     index,
+		TxnCount:  len(block.Data),
+		Branch:    []string{},
+	}
+	if block.Version >= BlockVersionWitness {
+		proof.TxnHash = TxnHash(block.Data[index])
+	}
+	level := txnMerkleLeaves(block.Version, block.Data)
+	for pos := index; len(level) > 1; pos /= 2 {
+		if sibling := pos ^ 1; sibling < len(level) {
+			proof.Branch = append(proof.Branch, hex.EncodeToString(level[sibling]))
+		}
+		level = nextMerkleLevel(level)
+	}
+	return proof, nil
+}
+
+// VerifyMerkleProof checks the proof shows the transaction is committed to by the given header. The header should
+// be one the caller already trusts (e.g. because it is part of a chain of headers with valid proof of work) rather
+// than the copy included in the proof.
+func VerifyMerkleProof(proof *MerkleProof, header *BlockHeader) error {
+	if header.Version < BlockVersionHeader {
+		return fmt.Errorf("block version %d does not commit to its transactions", header.Version)
+	}
+	if proof.Index < 0 || proof.Index >= proof.TxnCount {
+		return fmt.Errorf("txn index %d was out of range for %d txns", proof.Index, proof.TxnCount)
+	}
+
+	var digest []byte
+	if header.Version >= BlockVersionWitness {
+		var err error
+		if digest, err = hex.DecodeString(proof.TxnHash); err != nil || len(digest) != sha256.Size {
+			return fmt.Errorf("txn hash was not a hex encoded SHA-256 digest: %s", proof.TxnHash)
+		}
+	}
+	node := merkleLeaf(proof.TxnID, digest)
+	branch := proof.Branch
+	for pos, width := proof.Index, proof.TxnCount; width > 1; pos, width = pos/2, (width+1)/2 {
+		if pos == width-1 && width%2 == 1 {
+			continue //no sibling, carried up unchanged
+		}
+		if len(branch) == 0 {
+			return fmt.Errorf("merkle branch was too short")
+		}
+		sibling, err := hex.DecodeString(branch[0])
+		if err != nil || len(sibling) != sha256.Size {
+			return fmt.Errorf("merkle branch contained an invalid hash: %s", branch[0])
+		}
+		branch = branch[1:]
+		if pos%2 == 0 {
+			node = merkleNode(node, sibling)
+		} else {
+			node = merkleNode(sibling, node)
+		}
+	}
+	if len(branch) != 0 {
+		return fmt.Errorf("merkle branch was too long")
+	}
+	if root := hex.EncodeToString(node); root != header.MerkleRoot {
+		return fmt.Errorf("merkle proof did not match header: expected root %s got %s", header.MerkleRoot, root)
+	}
+	return nil
+}
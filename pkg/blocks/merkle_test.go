@@ -0,0 +1,186 @@
+package blocks
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func testMerkleBlock(n int) *Block {
+	txns := make([]*Transaction, n)
+	for k := range txns {
+		txns[k] = &Transaction{ID: fmt.Sprintf("txn-%d", k)}
+	}
+	return &Block{BlockHeader: BlockHeader{Version: CurrentBlockVersion, MerkleRoot: TxnMerkleRoot(CurrentBlockVersion, txns)}, Data: txns}
+}
+
+func TestTxnMerkleRoot(t *testing.T) {
+	leaf := func(k int) []byte {
+		return merkleLeaf(fmt.Sprintf("txn-%d", k), txnHash(&Transaction{ID: fmt.Sprintf("txn-%d", k)}))
+	}
+	tests := []struct {
+		n        int
+		expected []byte
+	}{
+		{n: 1, expected: leaf(0)},
+		{n: 2, expected: merkleNode(leaf(0), leaf(1))},
+		// the odd leaf is carried up unchanged
+		{n: 3, expected: merkleNode(merkleNode(leaf(0), leaf(1)), leaf(2))},
+		{n: 5, expected: merkleNode(merkleNode(merkleNode(leaf(0), leaf(1)), merkleNode(leaf(2), leaf(3))), leaf(4))},
+		{n: 6, expected: merkleNode(merkleNode(merkleNode(leaf(0), leaf(1)), merkleNode(leaf(2), leaf(3))), merkleNode(leaf(4), leaf(5)))},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%d txns", test.n), func(t *testing.T) {
+			if got, expected := testMerkleBlock(test.n).MerkleRoot, hex.EncodeToString(test.expected); got != expected {
+				t.Fatalf("expected root %s got %s", expected, got)
+			}
+		})
+	}
+}
+
+func TestVerifyMerkleProof(t *testing.T) {
+	for n := 1; n <= 7; n++ {
+		block := testMerkleBlock(n)
+		for index := 0; index < n; index++ {
+			t.Run(fmt.Sprintf("txn %d of %d", index, n), func(t *testing.T) {
+				proof, err := NewMerkleProof(block, block.Data[index].ID)
+				if err != nil {
+					t.Fatalf("failed to create proof: %s", err)
+				}
+				if err := VerifyMerkleProof(proof, &block.BlockHeader); err != nil {
+					t.Fatalf("expected proof to verify: %s", err)
+				}
+			})
+		}
+	}
+}
+
+func TestVerifyMerkleProofRejectsInvalidProofs(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(p *MerkleProof)
+		err    string
+	}{
+		{
+			name: "tampered branch",
+			tamper: func(p *MerkleProof) {
+				sibling, _ := hex.DecodeString(p.Branch[0])
+				sibling[0] ^= 1
+				p.Branch[0] = hex.EncodeToString(sibling)
+			},
+			err: "did not match header",
+		},
+		{
+			name:   "branch entries swapped",
+			tamper: func(p *MerkleProof) { p.Branch[0], p.Branch[1] = p.Branch[1], p.Branch[0] },
+			err:    "did not match header",
+		},
+		{name: "wrong index", tamper: func(p *MerkleProof) { p.Index ^= 1 }, err: "did not match header"},
+		{name: "index out of range", tamper: func(p *MerkleProof) { p.Index = p.TxnCount }, err: "out of range"},
+		{name: "negative index", tamper: func(p *MerkleProof) { p.Index = -1 }, err: "out of range"},
+		{name: "wrong txn", tamper: func(p *MerkleProof) { p.TxnID = "txn-99" }, err: "did not match header"},
+		{name: "wrong txn hash", tamper: func(p *MerkleProof) { p.TxnHash = TxnHash(&Transaction{Version: 1}) }, err: "did not match header"},
+		{name: "missing txn hash", tamper: func(p *MerkleProof) { p.TxnHash = "" }, err: "txn hash was not"},
+		{
+			name:   "extra branch entry",
+			tamper: func(p *MerkleProof) { p.Branch = append(p.Branch, p.Branch[0]) },
+			err:    "too long",
+		},
+		{name: "missing branch entry", tamper: func(p *MerkleProof) { p.Branch = p.Branch[1:] }, err: "too short"},
+		{name: "invalid branch hash", tamper: func(p *MerkleProof) { p.Branch[0] = "zz" }, err: "invalid hash"},
+		{name: "short branch hash", tamper: func(p *MerkleProof) { p.Branch[0] = p.Branch[0][:62] }, err: "invalid hash"},
+		// a proof for the carried up odd leaf of a wider tree has fewer levels than a proof for a narrower tree
+		{name: "wrong txn count", tamper: func(p *MerkleProof) { p.TxnCount = 5 }, err: "too long"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			block := testMerkleBlock(7)
+			proof, err := NewMerkleProof(block, block.Data[4].ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.tamper(proof)
+
+			err = VerifyMerkleProof(proof, &block.BlockHeader)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestVerifyMerkleProofRequiresHeaderVersion(t *testing.T) {
+	block := testMerkleBlock(2)
+	proof, err := NewMerkleProof(block, block.Data[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := block.BlockHeader
+	header.Version = BlockVersionTarget
+	if err := VerifyMerkleProof(proof, &header); err == nil {
+		t.Fatal("expected header without a merkle root to be rejected")
+	}
+
+	block.Version = BlockVersionTarget
+	if _, err := NewMerkleProof(block, block.Data[0].ID); err == nil {
+		t.Fatal("expected proof of block without a merkle root to fail")
+	}
+}
+
+func TestVerifyMerkleProofBeforeBlockVersionWitness(t *testing.T) {
+	block := testMerkleBlock(3)
+	block.Version = BlockVersionCanonicalTxn
+	block.MerkleRoot = TxnMerkleRoot(block.Version, block.Data)
+	if expected := hex.EncodeToString(merkleNode(merkleNode(merkleLeaf("txn-0", nil), merkleLeaf("txn-1", nil)), merkleLeaf("txn-2", nil))); block.MerkleRoot != expected {
+		t.Fatalf("expected root over txn IDs %s got %s", expected, block.MerkleRoot)
+	}
+	for index := range block.Data {
+		proof, err := NewMerkleProof(block, block.Data[index].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proof.TxnHash != "" {
+			t.Fatal("expected proof of an earlier block version not to have a txn hash")
+		}
+		if err := VerifyMerkleProof(proof, &block.BlockHeader); err != nil {
+			t.Fatalf("expected proof to verify: %s", err)
+		}
+	}
+}
+
+func TestBlockHashCommitsToSignatures(t *testing.T) {
+	first, second := testKey(t), testKey(t)
+	txn, unspent := testMultiInputTxn(t, first, second)
+	signAll(t, txn, unspent, first, first, second)
+
+	hashWithSignatures := func(version int) (string, string) {
+		block := mineTestBlock(t, Genesis, "miner", txn)
+		block.Version = version
+		block.MerkleRoot = TxnMerkleRoot(version, block.Data)
+		before, err := Hash(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// swap the signatures of the two txn ins spending txn outs of the same key
+		in0, _ := txn.GetTxnIn(0)
+		in1, _ := txn.GetTxnIn(1)
+		in0.Signature, in1.Signature = in1.Signature, in0.Signature
+		defer func() { in0.Signature, in1.Signature = in1.Signature, in0.Signature }()
+		block.MerkleRoot = TxnMerkleRoot(version, block.Data)
+		after, err := Hash(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return before, after
+	}
+
+	if before, after := hashWithSignatures(BlockVersionWitness); before == after {
+		t.Fatal("expected the block hash to change when signatures change")
+	}
+	// earlier versions only commit to txn IDs
+	if before, after := hashWithSignatures(BlockVersionCanonicalTxn); before != after {
+		t.Fatal("expected the block hash of an earlier version not to commit to signatures")
+	}
+}
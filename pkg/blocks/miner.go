@@ -0,0 +1,151 @@
+package blocks
+
+import (
+	"context"
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrMiningAborted is returned when mining is cancelled before a nonce is found.
+var ErrMiningAborted = errors.New("mining aborted")
+
+const (
+	// hashRateSampleSize is how many hashes a worker tries between checking for cancellation and reporting progress.
+	hashRateSampleSize = 1000
+
+	maxNonce = int(^uint(0) >> 1)
+)
+
+// NewMiner creates a miner that uses the given number of goroutines. Zero or less uses one per CPU.
+func NewMiner(workers int) *Miner {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return &Miner{workers: workers}
+}
+
+// Miner searches for a nonce that satisfies a block's target. The nonce space is split between workers so that
+// worker k tries k, k+N, k+2N... If a worker exhausts its nonces it bumps its copy of the block's timestamp by a
+// second and starts again.
+type Miner struct {
+	workers int
+
+	mu       sync.RWMutex
+	hashes   uint64
+	started  time.Time
+	finished time.Time
+}
+
+// Mine updates the block's nonce (and possibly timestamp) and hash so that it meets its target. It returns
+// ErrMiningAborted if the context is cancelled first.
+func (m *Miner) Mine(ctx context.Context, block *Block) error {
+	m.mu.Lock()
+	atomic.StoreUint64(&m.hashes, 0)
+	m.started = time.Now()
+	m.finished = time.Time{}
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		m.finished = time.Now()
+		m.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	found := make(chan *Block, m.workers)
+	errs := make(chan error, m.workers)
+	wg := &sync.WaitGroup{}
+	for k := 0; k < m.workers; k++ {
+		candidate := *block
+		candidate.Nonce = k
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m.work(ctx, &candidate); err != nil {
+				errs <- err
+				return
+			}
+			found <- &candidate
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(found)
+	}()
+
+	for {
+		select {
+		case solved, ok := <-found:
+			if !ok {
+				return ErrMiningAborted
+			}
+			cancel()
+			block.Timestamp = solved.Timestamp
+			block.Nonce = solved.Nonce
+			block.Hash = solved.Hash
+			log.Printf("Found block nonce %d in %0.2f seconds (%0.0f H/s)", block.Nonce, m.elapsed().Seconds(), m.HashRate())
+			return nil
+		case err := <-errs:
+			if err != ErrMiningAborted {
+				return err
+			}
+		}
+	}
+}
+
+// HashRate is the number of hashes per second achieved by the current (or last) call to Mine.
+func (m *Miner) HashRate() float64 {
+	elapsed := m.elapsed().Seconds()
+	if elapsed == 0 {
+		return 0
+	}
+	return float64(atomic.LoadUint64(&m.hashes)) / elapsed
+}
+
+func (m *Miner) elapsed() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.started.IsZero() {
+		return 0
+	}
+	if m.finished.IsZero() {
+		return time.Since(m.started)
+	}
+	return m.finished.Sub(m.started)
+}
+
+func (m *Miner) work(ctx context.Context, block *Block) error {
+	start := block.Nonce
+	for attempts := 1; ; attempts++ {
+		var err error
+		if block.Hash, err = Hash(block); err != nil {
+			return err
+		}
+		if err := hashMatchesDifficulty(block); err == nil {
+			atomic.AddUint64(&m.hashes, uint64(attempts%hashRateSampleSize))
+			return nil
+		}
+		if attempts%hashRateSampleSize == 0 {
+			atomic.AddUint64(&m.hashes, hashRateSampleSize)
+			select {
+			case <-ctx.Done():
+				return ErrMiningAborted
+			default:
+			}
+		}
+		if block.Nonce > maxNonce-m.workers {
+			block.Timestamp = block.Timestamp.Add(time.Second)
+			block.Nonce = start
+			continue
+		}
+		block.Nonce += m.workers
+	}
+}
@@ -0,0 +1,30 @@
+package blocks
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+// TestMinerConcurrentMine shares a Miner between concurrent calls as the server does for handleMine and background
+// mining. Run with -race.
+func TestMinerConcurrentMine(t *testing.T) {
+	miner := NewMiner(2)
+	wg := &sync.WaitGroup{}
+	for k := 0; k < 4; k++ {
+		block := mineTestBlock(t, Genesis, "miner")
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := miner.Mine(context.Background(), block); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := hashMatchesDifficulty(block); err != nil {
+				t.Error(err)
+			}
+			miner.HashRate()
+		}()
+	}
+	wg.Wait()
+}
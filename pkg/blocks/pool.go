@@ -0,0 +1,167 @@
+package blocks
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var ErrTxnExists = errors.New("transaction already exists in pool")
+
+// blockTemplateReserve is the space left in a block template for the header and coinbase txn.
+const blockTemplateReserve = 1024
+
+func NewTxnPool() *TxnPool {
+	return &TxnPool{
+		txns:  []*Transaction{},
+		index: make(map[string]*Transaction),
+		spent: make(map[TxnOutRef]string),
+	}
+}
+
+// TxnPool holds valid transactions that have not yet been included in a block.
+type TxnPool struct {
+	mu    sync.RWMutex
+	txns  []*Transaction
+	index map[string]*Transaction
+	spent map[TxnOutRef]string
+}
+
+// Add validates the transaction against the unspent set and adds it to the pool. Transactions that spend a txn out
+// already referenced by a pooled transaction are rejected.
+func (p *TxnPool) Add(txn *Transaction, unspent *TxnOutUnspentSet) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, found := p.index[txn.ID]; found {
+		return ErrTxnExists
+	}
+	if txn.Version < TxnVersionCanonical {
+		return fmt.Errorf("txn version %d can no longer be mined", txn.Version)
+	}
+	for _, ref := range txn.TxnIn.Spent() {
+		if otherID, found := p.spent[ref]; found {
+			return fmt.Errorf("txn out %s/%d is already spent by pooled txn %s", ref.TxnOutID, ref.TxnOutIndex, otherID)
+		}
+	}
+	if err := txn.Validate(unspent); err != nil {
+		return errors.Wrap(err, "invalid transaction")
+	}
+	p.add(txn)
+	return nil
+}
+
+// Get returns the pooled transaction with the given ID or nil if it is not in the pool.
+func (p *TxnPool) Get(id string) *Transaction {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.index[id]
+}
+
+// Txns returns all pooled transactions in the order they were added.
+func (p *TxnPool) Txns() []*Transaction {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	c := make([]*Transaction, len(p.txns))
+	copy(c, p.txns)
+	return c
+}
+
+// BlockTxns selects the pooled transactions to include in a new block with the given index and timestamp along with
+// their total fee. Transactions that are still time locked are skipped. The rest are chosen in order of fee per byte
+// (then the order they were added) until the block is full.
+func (p *TxnPool) BlockTxns(unspent *TxnOutUnspentSet, blockIndex int64, blockTime time.Time) ([]*Transaction, int64) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	type candidate struct {
+		txn  *Transaction
+		fee  int64
+		size int64
+	}
+	candidates := make([]candidate, 0, len(p.txns))
+	for _, txn := range p.txns {
+		fee, err := txn.Fee(unspent)
+		if err != nil {
+			continue
+		}
+		if err := txn.ValidateTimeLocks(unspent, blockIndex, blockTime); err != nil {
+			continue
+		}
+		encoded, err := txn.MarshalBinary()
+		if err != nil {
+			continue
+		}
+		candidates = append(candidates, candidate{txn: txn, fee: fee, size: int64(len(encoded))})
+	}
+	// compare fee rates without dividing: a.fee/a.size > b.fee/b.size
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].fee*candidates[j].size > candidates[j].fee*candidates[i].size
+	})
+
+	selected := []*Transaction{}
+	fees := int64(0)
+	space := int64(MaxBlockSize - blockTemplateReserve)
+	for _, c := range candidates {
+		if len(selected) >= MaxBlockTxns-1 {
+			break
+		}
+		if c.size > space {
+			continue
+		}
+		selected = append(selected, c.txn)
+		fees += c.fee
+		space -= c.size
+	}
+	return selected, fees
+}
+
+func (p *TxnPool) Len() int64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return int64(len(p.txns))
+}
+
+// Update removes any transactions that spend txn outs no longer in the unspent set e.g. because they were included
+// in a block.
+func (p *TxnPool) Update(unspent *TxnOutUnspentSet) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	txns := p.txns
+	p.reset()
+	for _, txn := range txns {
+		if isSpendable(txn, unspent) {
+			p.add(txn)
+		}
+	}
+}
+
+func (p *TxnPool) add(txn *Transaction) {
+	p.txns = append(p.txns, txn)
+	p.index[txn.ID] = txn
+	for _, ref := range txn.TxnIn.Spent() {
+		p.spent[ref] = txn.ID
+	}
+}
+
+func (p *TxnPool) reset() {
+	p.txns = []*Transaction{}
+	p.index = make(map[string]*Transaction)
+	p.spent = make(map[TxnOutRef]string)
+}
+
+func isSpendable(txn *Transaction, unspent *TxnOutUnspentSet) bool {
+	for _, ref := range txn.TxnIn.Spent() {
+		if unspent.Get(ref.TxnOutID, ref.TxnOutIndex) == nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,43 @@
+package blocks
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/warmans/catbux/pkg/crypto"
+)
+
+func TestTxnPoolRejectsDuplicateTxnIns(t *testing.T) {
+	key := testKey(t)
+	address, err := crypto.PubKeyToBase64(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unspent := NewTxnOutUnspentSet()
+	unspent.Add(&TxnOutUnspent{TxnOutID: "funding", TxnOutIndex: 0, Address: address, Amount: 10})
+
+	// TxnInSet.Append skips repeated txn outs but a transaction decoded from a peer keeps them
+	txn := &Transaction{Version: CurrentTxnVersion, TxnOut: []*TxnOut{{Address: testAddress("receiver"), Amount: 20}}}
+	ins := `[{"txn_out_id":"funding","txn_out_index":0},{"txn_out_id":"funding","txn_out_index":0}]`
+	if err := txn.TxnIn.UnmarshalJSON([]byte(ins)); err != nil {
+		t.Fatal(err)
+	}
+	txn.ID = GetTransactionID(txn)
+	signAll(t, txn, unspent, key, key)
+
+	pool := NewTxnPool()
+	if err := pool.Add(txn, unspent); err == nil || !strings.Contains(err.Error(), "same txn out") {
+		t.Fatalf("expected txn spending the same txn out twice to be rejected got %v", err)
+	}
+	if len(pool.Txns()) != 0 {
+		t.Fatal("rejected txn was pooled")
+	}
+
+	valid := &Transaction{Version: CurrentTxnVersion, TxnOut: []*TxnOut{{Address: testAddress("receiver"), Amount: 10}}}
+	valid.TxnIn.Append(&TxnIn{TxnOutID: "funding", TxnOutIndex: 0})
+	valid.ID = GetTransactionID(valid)
+	signAll(t, valid, unspent, key)
+	if err := pool.Add(valid, unspent); err != nil {
+		t.Fatalf("expected txn to be pooled: %s", err)
+	}
+}
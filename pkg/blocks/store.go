@@ -0,0 +1,38 @@
+package blocks
+
+import (
+	"github.com/pkg/errors"
+)
+
+// Store persists the blocks of the main chain (including the genesis block).
+type Store interface {
+	// Load returns all stored blocks ordered by index.
+	Load() ([]*Block, error)
+	// Append adds a block to the end of the store.
+	Append(block *Block) error
+	// Truncate removes all blocks with an index greater than or equal to the given index.
+	Truncate(index int64) error
+	Close() error
+}
+
+// LoadBlockchain creates a Blockchain backed by the given store. Stored blocks are validated and replayed to rebuild
+// the unspent txn out set. An empty store is initialised with the genesis block.
+func LoadBlockchain(store Store) (*Blockchain, error) {
+	stored, err := store.Load()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load blocks from store")
+	}
+	if len(stored) == 0 {
+		if err := store.Append(Genesis); err != nil {
+			return nil, errors.Wrap(err, "failed to store genesis block")
+		}
+		stored = []*Block{Genesis}
+	}
+
+	chain := &Blockchain{Blocks: stored, store: store}
+	if chain.unspent, chain.deltas, err = chain.validate(); err != nil {
+		return nil, errors.Wrap(err, "stored chain was invalid")
+	}
+	chain.indexMainChain()
+	return chain, nil
+}
@@ -0,0 +1,139 @@
+package blocks
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+)
+
+var (
+	// PowLimit is the easiest target a block may have.
+	PowLimit = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 248), big.NewInt(1))
+
+	// RetargetClampFactor limits how far the target can move at each adjustment. The measured time taken to mine an
+	// adjustment interval is clamped to between 1/factor and factor times the expected time.
+	RetargetClampFactor int64 = 4
+
+	// twoTo256 is the number of possible hashes, used to convert targets to work.
+	twoTo256 = new(big.Int).Lsh(big.NewInt(1), 256)
+)
+
+// CompactToTarget expands compact "bits" into a 256-bit target. The top byte of bits is the size of the target in
+// bytes and the lower three bytes are its most significant bytes.
+func CompactToTarget(bits uint32) *big.Int {
+	size := uint(bits >> 24)
+	target := big.NewInt(int64(bits & 0x007fffff))
+	if size <= 3 {
+		return target.Rsh(target, 8*(3-size))
+	}
+	return target.Lsh(target, 8*(size-3))
+}
+
+// TargetToCompact encodes a target as compact "bits". Precision below the three most significant bytes is lost.
+func TargetToCompact(target *big.Int) uint32 {
+	size := uint((target.BitLen() + 7) / 8)
+	var mantissa uint64
+	if size <= 3 {
+		mantissa = target.Uint64() << (8 * (3 - size))
+	} else {
+		mantissa = new(big.Int).Rsh(target, 8*(size-3)).Uint64()
+	}
+	// the top bit of the mantissa would be read as a sign so move to the next size instead
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		size++
+	}
+	return uint32(size)<<24 | uint32(mantissa)
+}
+
+// validateBits checks compact bits decode to a usable target.
+func validateBits(bits uint32) error {
+	if bits&0x00800000 != 0 {
+		return fmt.Errorf("bits %08x encode a negative target", bits)
+	}
+	target := CompactToTarget(bits)
+	if target.Sign() <= 0 {
+		return fmt.Errorf("bits %08x encode a zero target", bits)
+	}
+	if target.Cmp(PowLimit) > 0 {
+		return fmt.Errorf("bits %08x encode a target above the limit", bits)
+	}
+	return nil
+}
+
+// blockTarget is the target the block's hash had to meet. Blocks before BlockVersionTarget express difficulty as
+// leading zero bits which is converted to the equivalent target.
+func blockTarget(b *Block) *big.Int {
+	if b.Version >= BlockVersionTarget {
+		return CompactToTarget(b.Bits)
+	}
+	difficulty := b.Difficulty
+	if difficulty < 0 {
+		difficulty = 0
+	}
+	target := new(big.Int).Rsh(twoTo256, uint(difficulty))
+	target.Sub(target, big.NewInt(1))
+	if target.Cmp(PowLimit) > 0 {
+		return new(big.Int).Set(PowLimit)
+	}
+	return target
+}
+
+// blockWork is the expected number of hashes required to mine the block. BlockVersionLegacy difficulty is checked
+// against base64 characters whose leading bits are fixed so it says little about the work done. Legacy blocks are
+// credited a single hash to stop a cheap branch of them outweighing real work.
+func blockWork(b *Block) *big.Int {
+	if b.Version == BlockVersionLegacy {
+		return big.NewInt(1)
+	}
+	if b.Version < BlockVersionTarget {
+		difficulty := b.Difficulty
+		if difficulty < 0 {
+			difficulty = 0
+		}
+		return new(big.Int).Lsh(big.NewInt(1), uint(difficulty))
+	}
+	target := CompactToTarget(b.Bits)
+	return new(big.Int).Div(twoTo256, target.Add(target, big.NewInt(1)))
+}
+
+// validateBlockBits checks the block's bits are those required after its parent.
+func validateBlockBits(block *Block, parent *blockNode) error {
+	if block.Version < BlockVersionTarget {
+		return nil
+	}
+	if expected := nextBits(parent); block.Bits != expected {
+		return fmt.Errorf("block bits were wrong: expected %08x got %08x", expected, block.Bits)
+	}
+	return nil
+}
+
+// nextBits calculates the bits required of a block following parent. The target only changes at the start of each
+// DifficultyAdjustmentInterval, in proportion to how long the previous interval took to mine.
+func nextBits(parent *blockNode) uint32 {
+	target := blockTarget(parent.block)
+	if (parent.block.Index+1)%DifficultyAdjustmentInterval != 0 {
+		return TargetToCompact(target)
+	}
+
+	first := parent
+	for k := 1; k < DifficultyAdjustmentInterval && first.parent != nil; k++ {
+		first = first.parent
+	}
+
+	expected := int64(BlockGenerationInterval * DifficultyAdjustmentInterval * time.Second)
+	actual := int64(parent.block.Timestamp.Sub(first.block.Timestamp))
+	if actual < expected/RetargetClampFactor {
+		actual = expected / RetargetClampFactor
+	}
+	if actual > expected*RetargetClampFactor {
+		actual = expected * RetargetClampFactor
+	}
+
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+	if target.Cmp(PowLimit) > 0 {
+		target.Set(PowLimit)
+	}
+	return TargetToCompact(target)
+}
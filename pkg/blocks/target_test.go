@@ -0,0 +1,27 @@
+package blocks
+
+import (
+	"math/big"
+	"testing"
+)
+
+func TestBlockWork(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   BlockHeader
+		expected int64
+	}{
+		{name: "legacy", header: BlockHeader{Version: BlockVersionLegacy, Difficulty: 1}, expected: 1},
+		{name: "legacy with high difficulty", header: BlockHeader{Version: BlockVersionLegacy, Difficulty: 60}, expected: 1},
+		{name: "raw pow", header: BlockHeader{Version: BlockVersionRawPoW, Difficulty: 4}, expected: 16},
+		{name: "raw pow negative difficulty", header: BlockHeader{Version: BlockVersionRawPoW, Difficulty: -1}, expected: 1},
+		{name: "target", header: BlockHeader{Version: BlockVersionTarget, Bits: 0x1f00ffff}, expected: 65537},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := blockWork(&Block{BlockHeader: test.header}); got.Cmp(big.NewInt(test.expected)) != 0 {
+				t.Fatalf("expected work %d got %s", test.expected, got)
+			}
+		})
+	}
+}
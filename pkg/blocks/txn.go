@@ -1,31 +1,64 @@
 package blocks
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/warmans/catbux/pkg/crypto"
 )
 
+// CoinbaseAmount is the reward minted to the miner of each block. The miner also collects the fees of the block's
+// transactions.
+const CoinbaseAmount = 50
+
+const (
+	// TxnVersionLegacy transactions have an ID made by concatenating their fields without separators. They are only
+	// accepted in blocks before BlockVersionCanonicalTxn.
+	TxnVersionLegacy = 0
+	// TxnVersionCanonical transactions have an ID that is the hash of their canonical encoding.
+	TxnVersionCanonical = 1
+	// TxnVersionLockTime transactions have a LockTime and each txn in has a RelativeLock.
+	TxnVersionLockTime = 2
+	// TxnVersionLock transactions can create txn outs with a Lock and spend them with a Witness.
+	TxnVersionLock = 3
+	// TxnVersionPubKeyHash transactions can spend txn outs paid to a crypto.PubKeyToAddress address by revealing the
+	// PubKey of each txn in.
+	TxnVersionPubKeyHash = 4
+
+	// CurrentTxnVersion is the version of newly created transactions.
+	CurrentTxnVersion = TxnVersionPubKeyHash
+
+	// LockTimeThreshold separates lock times that are block heights (below) from those that are unix timestamps.
+	LockTimeThreshold = 500000000
+)
+
 type TxnInSet struct {
 	mu    sync.RWMutex
 	set   []*TxnIn
-	index map[string]struct{}
+	index map[TxnOutRef]struct{}
 }
 
 func (s *TxnInSet) Append(txn *TxnIn) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if _, found := s.index[txn.TxnOutID]; found {
+	ref := TxnOutRef{TxnOutID: txn.TxnOutID, TxnOutIndex: txn.TxnOutIndex}
+	if _, found := s.index[ref]; found {
 		return
 	}
+	if s.index == nil {
+		s.index = make(map[TxnOutRef]struct{})
+	}
+	s.index[ref] = struct{}{}
 	s.set = append(s.set, txn)
 }
 
@@ -36,19 +69,22 @@ func (s *TxnInSet) Len() int64 {
 	return int64(len(s.set))
 }
 
-func (s *TxnInSet) TotalValue(txn *Transaction, unspent []*TxnOutUnspent) (int64, error) {
+func (s *TxnInSet) TotalValue(txn *Transaction, unspent *TxnOutUnspentSet) (int64, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
 	totalTxnInValue := int64(0)
-	for _, in := range s.set {
-		if err := in.Validate(txn, unspent); err != nil {
+	for k, in := range s.set {
+		if err := in.Validate(txn, int64(k), unspent); err != nil {
 			return 0, errors.Wrapf(err, "txn id %s contained invalid txn in data", txn.ID)
 		}
 		amnt, err := getTxnInAmount(in, unspent)
 		if err != nil {
 			return 0, err
 		}
+		if totalTxnInValue+amnt < totalTxnInValue {
+			return 0, fmt.Errorf("txn id %s total in value overflowed", txn.ID)
+		}
 		totalTxnInValue += amnt
 	}
 	return totalTxnInValue, nil
@@ -67,7 +103,7 @@ func (s *TxnInSet) Get(index int64) (*TxnIn, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	if index >= s.Len() {
+	if index < 0 || index >= int64(len(s.set)) {
 		return nil, fmt.Errorf("invalid IN TXN index: %d", index)
 	}
 	return s.set[index], nil
@@ -80,10 +116,29 @@ func (s *TxnInSet) MarshalJSON() ([]byte, error) {
 	return json.Marshal(s.set)
 }
 
-func (s *TxnInSet) Spent() []*TxnOutSpent {
-	c := make([]*TxnOutSpent, len(s.set))
+func (s *TxnInSet) UnmarshalJSON(data []byte) error {
+	set := []*TxnIn{}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.set = set
+	s.index = make(map[TxnOutRef]struct{}, len(set))
+	for _, in := range set {
+		s.index[TxnOutRef{TxnOutID: in.TxnOutID, TxnOutIndex: in.TxnOutIndex}] = struct{}{}
+	}
+	return nil
+}
+
+func (s *TxnInSet) Spent() []TxnOutRef {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c := make([]TxnOutRef, len(s.set))
 	for k, in := range s.set {
-		c[k] = &TxnOutSpent{TxnOutID: in.TxnOutID, TxnOutIndex: in.TxnOutIndex}
+		c[k] = TxnOutRef{TxnOutID: in.TxnOutID, TxnOutIndex: in.TxnOutIndex}
 	}
 	return c
 }
@@ -92,19 +147,87 @@ type TxnIn struct {
 	TxnOutID    string `json:"txn_out_id"`
 	TxnOutIndex int64  `json:"txn_out_index"`
 	Signature   string `json:"signature"`
+	// RelativeLock is the number of blocks that must follow the block that created the spent txn out before it can
+	// be spent by this txn in.
+	RelativeLock int64 `json:"relative_lock,omitempty"`
+	// Witness satisfies the lock of the spent txn out. It is used instead of Signature for txn outs with a Lock.
+	Witness *Witness `json:"witness,omitempty"`
+	// PubKey is the hex encoded compressed public key of the address of the spent txn out. It is only set when the
+	// txn out is paid to a pub key hash address rather than a public key.
+	PubKey string `json:"pub_key,omitempty"`
 }
 
-func (t *TxnIn) Validate(txn *Transaction, unspent []*TxnOutUnspent) error {
-	found := findUnspentTxnOut(t.TxnOutID, t.TxnOutIndex, unspent)
+// Validate checks the txn in (at the given index of txn) spends an unspent txn out and is signed by its owner (or
+// satisfies its lock). Time locks within the lock are not checked.
+func (t *TxnIn) Validate(txn *Transaction, index int64, unspent *TxnOutUnspentSet) error {
+	found := unspent.Get(t.TxnOutID, t.TxnOutIndex)
 	if found == nil {
 		return fmt.Errorf("unspent txn out not found")
 	}
-	pubKey, err := crypto.PubKeyFromBase64(found.Address)
+	if found.Lock != "" {
+		return t.validateLock(txn, index, found, &lockContext{})
+	}
+	if !t.Witness.empty() {
+		return fmt.Errorf("witness given for txn out without a lock")
+	}
+	pubKey, err := t.spendingKey(found)
 	if err != nil {
 		return err
 	}
-	if !crypto.Verify([]byte(txn.ID), []byte(t.Signature), pubKey) {
-		return fmt.Errorf("failed to verify transaction ID against signature/key")
+	signature, err := base64.URLEncoding.DecodeString(t.Signature)
+	if err != nil {
+		return errors.Wrap(err, "signature was not valid base64")
+	}
+	if !crypto.Verify(SignatureHash(txn, index, found), signature, pubKey) {
+		return fmt.Errorf("failed to verify signature hash against signature/key")
+	}
+	return nil
+}
+
+// spendingKey is the public key that must sign to spend the txn out. Txn outs paid to a pub key hash address are
+// spent by revealing the key in PubKey.
+func (t *TxnIn) spendingKey(spent *TxnOutUnspent) (*ecdsa.PublicKey, error) {
+	pubKeyHash, err := crypto.DecodeAddress(spent.Address)
+	if err != nil {
+		if t.PubKey != "" {
+			return nil, fmt.Errorf("pub key given for txn out not paid to a pub key hash")
+		}
+		return crypto.PubKeyFromBase64(spent.Address)
+	}
+	compressed, err := hex.DecodeString(t.PubKey)
+	if err != nil {
+		return nil, fmt.Errorf("pub key was not valid hex")
+	}
+	pubKey, err := crypto.DecompressPubKey(compressed)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(crypto.PubKeyHash(pubKey), pubKeyHash) {
+		return nil, fmt.Errorf("pub key did not match address %s", spent.Address)
+	}
+	return pubKey, nil
+}
+
+// validateLock checks the witness satisfies the spent txn out's lock. The block details in ctx are used to check
+// time locks if ctx.checkTime is set.
+func (t *TxnIn) validateLock(txn *Transaction, index int64, spent *TxnOutUnspent, ctx *lockContext) error {
+	if t.Signature != "" || t.PubKey != "" {
+		return fmt.Errorf("signature or pub key given for txn out with a lock (use the witness)")
+	}
+	lock, err := ParseLock(spent.Lock)
+	if err != nil {
+		return err
+	}
+	if err := validateWitnessSize(lock, t.Witness); err != nil {
+		return err
+	}
+	witnessCtx, err := newLockContext(t.Witness, SignatureHash(txn, index, spent))
+	if err != nil {
+		return err
+	}
+	witnessCtx.checkTime, witnessCtx.blockIndex, witnessCtx.blockTime = ctx.checkTime, ctx.blockIndex, ctx.blockTime
+	if !lock.satisfied(witnessCtx) {
+		return fmt.Errorf("witness did not satisfy lock")
 	}
 	return nil
 }
@@ -112,6 +235,9 @@ func (t *TxnIn) Validate(txn *Transaction, unspent []*TxnOutUnspent) error {
 type TxnOut struct {
 	Address string `json:"address"`
 	Amount  int64  `json:"amount"`
+	// Lock is the text of a condition that must be satisfied to spend the txn out. If it is set Address must be its
+	// LockAddress, otherwise the txn out is spent with a signature by the Address key.
+	Lock string `json:"lock,omitempty"`
 }
 
 type TxnOutUnspent struct {
@@ -119,45 +245,110 @@ type TxnOutUnspent struct {
 	TxnOutIndex int64  `json:"txn_out_index"`
 	Address     string `json:"address"`
 	Amount      int64  `json:"amount"`
-}
-
-type TxnOutSpent struct {
-	TxnOutID    string `json:"txn_out_id"`
-	TxnOutIndex int64  `json:"txn_out_index"`
+	// Height is the index of the block that created the txn out.
+	Height int64  `json:"height"`
+	Lock   string `json:"lock,omitempty"`
 }
 
 type Transaction struct {
-	ID     string    `json:"id"`
-	TxnIn  TxnInSet  `json:"txn_in"`
-	TxnOut []*TxnOut `json:"txn_out"`
+	Version int    `json:"version,omitempty"`
+	ID      string `json:"id"`
+	// LockTime is the block height (if below LockTimeThreshold) or unix time before which the transaction cannot be
+	// included in a block.
+	LockTime int64     `json:"lock_time,omitempty"`
+	TxnIn    TxnInSet  `json:"txn_in"`
+	TxnOut   []*TxnOut `json:"txn_out"`
 }
 
 func (t *Transaction) GetTxnIn(index int64) (*TxnIn, error) {
 	return t.TxnIn.Get(index)
 }
 
-func (t *Transaction) Validate(unspent []*TxnOutUnspent) error {
+func (t *Transaction) Validate(unspent *TxnOutUnspentSet) error {
+	_, err := t.Fee(unspent)
+	return err
+}
+
+// Fee validates the transaction and returns the amount by which its txn ins exceed its txn outs. The fee is collected
+// by the coinbase txn of the block that includes the transaction.
+func (t *Transaction) Fee(unspent *TxnOutUnspentSet) (int64, error) {
+	if err := validateTxnVersion(t); err != nil {
+		return 0, err
+	}
 	if t.ID != GetTransactionID(t) {
-		return fmt.Errorf("invalid transaction ID")
+		return 0, fmt.Errorf("invalid transaction ID")
+	}
+	// a decoded txn in set can contain the same txn out more than once which would count its value twice
+	if err := validateTxnInSets([]*Transaction{t}); err != nil {
+		return 0, err
 	}
 
-	totalTxnOutValue := int64(0)
-	for _, out := range t.TxnOut {
-		totalTxnOutValue += out.Amount
+	totalTxnOutValue, err := totalTxnOutValue(t)
+	if err != nil {
+		return 0, err
 	}
 
 	totalTxnInValue, err := t.TxnIn.TotalValue(t, unspent)
 	if err != nil {
-		return err
+		return 0, err
+	}
+
+	if totalTxnInValue < totalTxnOutValue {
+		return 0, fmt.Errorf("txn out values exceeded txn in values (total in: %d total out: %d)", totalTxnInValue, totalTxnOutValue)
+	}
+	return totalTxnInValue - totalTxnOutValue, nil
+}
+
+// IsFinal reports whether the transaction's lock time allows it to be included in a block with the given index and
+// timestamp.
+func (t *Transaction) IsFinal(blockIndex int64, blockTime time.Time) bool {
+	if t.LockTime < LockTimeThreshold {
+		return blockIndex >= t.LockTime
+	}
+	return blockTime.Unix() >= t.LockTime
+}
+
+// ValidateTimeLocks checks the transaction's lock time, the relative lock of each txn in and any time locks in the
+// locks of the spent txn outs allow it to be included in a block with the given index and timestamp.
+func (t *Transaction) ValidateTimeLocks(unspent *TxnOutUnspentSet, blockIndex int64, blockTime time.Time) error {
+	if !t.IsFinal(blockIndex, blockTime) {
+		return fmt.Errorf("txn id %s is locked until %d", t.ID, t.LockTime)
 	}
 
-	if totalTxnInValue != totalTxnOutValue {
-		return fmt.Errorf("failed to reconsile in/out values (total in: %d total out:%d", totalTxnInValue, totalTxnOutValue)
+	t.TxnIn.mu.RLock()
+	defer t.TxnIn.mu.RUnlock()
+
+	for k, in := range t.TxnIn.set {
+		if in.RelativeLock == 0 {
+			continue
+		}
+		spent := unspent.Get(in.TxnOutID, in.TxnOutIndex)
+		if spent == nil {
+			return fmt.Errorf("txn id %s txn in %d: unspent txn out not found", t.ID, k)
+		}
+		if blockIndex < spent.Height+in.RelativeLock {
+			return fmt.Errorf("txn id %s txn in %d is locked until block %d", t.ID, k, spent.Height+in.RelativeLock)
+		}
+	}
+
+	ctx := &lockContext{checkTime: true, blockIndex: blockIndex, blockTime: blockTime}
+	for k, in := range t.TxnIn.set {
+		spent := unspent.Get(in.TxnOutID, in.TxnOutIndex)
+		if spent == nil || spent.Lock == "" {
+			continue
+		}
+		if err := in.validateLock(t, int64(k), spent, ctx); err != nil {
+			return errors.Wrapf(err, "txn id %s txn in %d is locked at block %d", t.ID, k, blockIndex)
+		}
 	}
 	return nil
 }
 
+// GetTransactionID is the hash of the transaction excluding signatures.
 func GetTransactionID(t *Transaction) string {
+	if t.Version >= TxnVersionCanonical {
+		return canonicalTxnID(t)
+	}
 	hash := sha256.New()
 
 	t.TxnIn.WriteToHash(hash)
@@ -169,84 +360,242 @@ func GetTransactionID(t *Transaction) string {
 	return base64.URLEncoding.EncodeToString(hash.Sum(nil))
 }
 
-func SignTxnIn(txn *Transaction, txnInIndex int64, key *ecdsa.PrivateKey, unspent []*TxnOutUnspent) (string, error) {
+// NewCoinbaseTransaction creates the transaction that pays the block reward plus the fees of the block's other
+// transactions to the given address. It has a single TxnIn that references no output but carries the block index so
+// that coinbase transactions (and their IDs) are unique per block.
+func NewCoinbaseTransaction(address string, blockIndex int64, fees int64) *Transaction {
+	txn := &Transaction{Version: CurrentTxnVersion, TxnOut: []*TxnOut{{Address: address, Amount: CoinbaseAmount + fees}}}
+	txn.TxnIn.Append(&TxnIn{TxnOutID: "", TxnOutIndex: blockIndex})
+	txn.ID = GetTransactionID(txn)
+	return txn
+}
+
+// SignatureHash is the data signed to spend the txn out referenced by a txn in. It commits to the txn ID (and so
+// every txn in reference and txn out), the index of the txn in being signed and the txn out it spends so a signature
+// cannot be reused for a different input or transaction.
+func SignatureHash(txn *Transaction, txnInIndex int64, spent *TxnOutUnspent) []byte {
+	hash := sha256.New()
+	e := &encoder{w: hash}
+	e.writeString(txn.ID)
+	e.writeInt64(txnInIndex)
+	e.writeString(spent.TxnOutID)
+	e.writeInt64(spent.TxnOutIndex)
+	e.writeString(spent.Address)
+	e.writeInt64(spent.Amount)
+	return hash.Sum(nil)
+}
+
+// SignTxnIn signs the txn in at the given index with the key that owns the txn out it spends. The txn's ID must
+// already be set. The signature is returned base64 encoded.
+func SignTxnIn(txn *Transaction, txnInIndex int64, key *ecdsa.PrivateKey, unspent *TxnOutUnspentSet) (string, error) {
 	txnIn, err := txn.GetTxnIn(txnInIndex)
 	if err != nil {
 		return "", err
 	}
-	txnOutUnspentRef := findUnspentTxnOut(txnIn.TxnOutID, txnIn.TxnOutIndex, unspent)
+	txnOutUnspentRef := unspent.Get(txnIn.TxnOutID, txnIn.TxnOutIndex)
 	if txnOutUnspentRef == nil {
 		return "", fmt.Errorf("failed to find referenced unspent txn")
 	}
+	address, err := crypto.PubKeyToBase64(&key.PublicKey)
+	if err != nil || (address != txnOutUnspentRef.Address && crypto.PubKeyToAddress(&key.PublicKey) != txnOutUnspentRef.Address) {
+		return "", fmt.Errorf("key does not own txn out %s/%d", txnIn.TxnOutID, txnIn.TxnOutIndex)
+	}
 
-	signature, err := crypto.Sign([]byte(txn.ID), key)
+	signature, err := crypto.Sign(SignatureHash(txn, txnInIndex, txnOutUnspentRef), key)
 	if err != nil {
 		return "", err
 	}
 	return base64.URLEncoding.EncodeToString(signature), nil
-
 }
 
-func ProcessTransactions(txns []*Transaction, unspent []*TxnOutUnspent, blockIndex int64) error {
-	if err := ValidateBlockTransactions(txns, unspent, blockIndex); err != nil {
-		return err
+// SignTxnInLock signs the txn in at the given index with one of the keys named by the lock of the txn out it spends.
+// The signature is returned base64 encoded to be added to the txn in's Witness.
+func SignTxnInLock(txn *Transaction, txnInIndex int64, key *ecdsa.PrivateKey, unspent *TxnOutUnspentSet) (string, error) {
+	txnIn, err := txn.GetTxnIn(txnInIndex)
+	if err != nil {
+		return "", err
+	}
+	txnOutUnspentRef := unspent.Get(txnIn.TxnOutID, txnIn.TxnOutIndex)
+	if txnOutUnspentRef == nil {
+		return "", fmt.Errorf("failed to find referenced unspent txn")
+	}
+	lock, err := ParseLock(txnOutUnspentRef.Lock)
+	if err != nil {
+		return "", errors.Wrapf(err, "txn out %s/%d does not have a valid lock", txnIn.TxnOutID, txnIn.TxnOutIndex)
+	}
+	address, err := crypto.PubKeyToBase64(&key.PublicKey)
+	if err != nil {
+		return "", err
+	}
+	named := false
+	for _, k := range LockKeys(lock) {
+		named = named || k == address
+	}
+	if !named {
+		return "", fmt.Errorf("key is not named by the lock of txn out %s/%d", txnIn.TxnOutID, txnIn.TxnOutIndex)
 	}
 
-	return nil
+	signature, err := crypto.Sign(SignatureHash(txn, txnInIndex, txnOutUnspentRef), key)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(signature), nil
 }
 
-func ValidateBlockTransactions(txns []*Transaction, unspent []*TxnOutUnspent, blockIndex int64) error {
+// ProcessTransactions validates a block's transactions against the unspent set and then applies them to it. The
+// unspent set is only modified if all transactions are valid. The returned delta can be used to roll back the change.
+func ProcessTransactions(block *Block, unspent *TxnOutUnspentSet) (*TxnOutUnspentDelta, error) {
+	if err := ValidateBlockTransactions(block, unspent); err != nil {
+		return nil, err
+	}
+	return unspent.Apply(block.Data, block.Index), nil
+}
 
-	//todo: coninbase txn
+func ValidateBlockTransactions(block *Block, unspent *TxnOutUnspentSet) error {
+	txns, blockIndex := block.Data, block.Index
+	if len(txns) == 0 {
+		return fmt.Errorf("block %d did not contain a coinbase txn", blockIndex)
+	}
 
-	//check for duplication in txnIn records
-	if err := validateTxnInSets(txns); err != nil {
+	//check for duplication in txnIn records (coinbase has no real txn in)
+	if err := validateTxnInSets(txns[1:]); err != nil {
 		return err
 	}
 
-	for _, txn := range txns {
-		if err := txn.Validate(unspent); err != nil {
+	fees := int64(0)
+	for _, txn := range txns[1:] {
+		fee, err := txn.Fee(unspent)
+		if err != nil {
+			return err
+		}
+		if err := txn.ValidateTimeLocks(unspent, blockIndex, block.Timestamp); err != nil {
 			return err
 		}
+		if fees+fee < fees {
+			return fmt.Errorf("block %d total fees overflowed", blockIndex)
+		}
+		fees += fee
 	}
 
+	if err := validateCoinbaseTxn(txns[0], blockIndex, fees); err != nil {
+		return errors.Wrapf(err, "block %d contained an invalid coinbase txn", blockIndex)
+	}
 	return nil
 }
 
-func UpdateUnspentTxns(newTxns []*Transaction, unspent []*TxnOutUnspent) []*TxnOutUnspent {
+func validateCoinbaseTxn(txn *Transaction, blockIndex int64, fees int64) error {
+	if txn == nil {
+		return fmt.Errorf("coinbase txn was missing")
+	}
+	if err := validateTxnVersion(txn); err != nil {
+		return err
+	}
+	if txn.ID != GetTransactionID(txn) {
+		return fmt.Errorf("invalid transaction ID")
+	}
+	if txn.LockTime != 0 {
+		return fmt.Errorf("coinbase txn must not have a lock time")
+	}
+	if txn.TxnIn.Len() != 1 {
+		return fmt.Errorf("coinbase txn must have exactly one txn in (got %d)", txn.TxnIn.Len())
+	}
+	in, err := txn.GetTxnIn(0)
+	if err != nil {
+		return err
+	}
+	if in.TxnOutID != "" {
+		return fmt.Errorf("coinbase txn in must not reference a txn out (got %s)", in.TxnOutID)
+	}
+	if in.TxnOutIndex != blockIndex {
+		return fmt.Errorf("coinbase txn in index must match block index: expected %d got %d", blockIndex, in.TxnOutIndex)
+	}
+	if len(txn.TxnOut) != 1 || txn.TxnOut[0] == nil {
+		return fmt.Errorf("coinbase txn must have exactly one txn out (got %d)", len(txn.TxnOut))
+	}
+	if expected := CoinbaseAmount + fees; txn.TxnOut[0].Amount != expected {
+		return fmt.Errorf("coinbase txn amount was wrong: expected %d got %d", expected, txn.TxnOut[0].Amount)
+	}
+	return nil
+}
 
-	spent := make([]*TxnOutSpent, 0)
-	for _, txn := range newTxns {
-		spent = append(spent, txn.TxnIn.Spent()...)
+// validateTxnVersion checks the txn's version is known and it only uses fields supported by that version. Txn out
+// locks must be canonical and paid to their LockAddress. Txn outs without a lock must be paid to a valid address.
+func validateTxnVersion(txn *Transaction) error {
+	if txn.Version < TxnVersionLegacy || txn.Version > CurrentTxnVersion {
+		return fmt.Errorf("txn version %d is not known", txn.Version)
 	}
-	newUnspent := make([]*TxnOutUnspent, 0)
+	locks := txn.Version >= TxnVersionLockTime
+	if txn.LockTime < 0 || (!locks && txn.LockTime != 0) {
+		return fmt.Errorf("txn version %d cannot have lock time %d", txn.Version, txn.LockTime)
+	}
+
+	txn.TxnIn.mu.RLock()
+	defer txn.TxnIn.mu.RUnlock()
 
-	//filter now spent rows
-	for _, u := range unspent {
-		if !isSpent(spent, u.TxnOutID, u.TxnOutIndex) {
-			newUnspent = append(newUnspent, u)
+	for k, in := range txn.TxnIn.set {
+		if in.RelativeLock < 0 || (!locks && in.RelativeLock != 0) {
+			return fmt.Errorf("txn version %d txn in %d cannot have relative lock %d", txn.Version, k, in.RelativeLock)
+		}
+		if txn.Version < TxnVersionLock && !in.Witness.empty() {
+			return fmt.Errorf("txn version %d txn in %d cannot have a witness", txn.Version, k)
+		}
+		if txn.Version < TxnVersionPubKeyHash && in.PubKey != "" {
+			return fmt.Errorf("txn version %d txn in %d cannot have a pub key", txn.Version, k)
 		}
 	}
-	//add new unspent rows
-	for _, txn := range newTxns {
-		for i, out := range txn.TxnOut {
-			newUnspent = append(newUnspent, &TxnOutUnspent{TxnOutID: txn.ID, TxnOutIndex: int64(i), Address: out.Address, Amount: out.Amount})
+	for k, out := range txn.TxnOut {
+		if out == nil {
+			continue
+		}
+		if out.Lock == "" {
+			if err := validateTxnOutAddress(out.Address); err != nil {
+				return errors.Wrapf(err, "txn out %d", k)
+			}
+			continue
+		}
+		if txn.Version < TxnVersionLock {
+			return fmt.Errorf("txn version %d txn out %d cannot have a lock", txn.Version, k)
+		}
+		lock, err := ParseLock(out.Lock)
+		if err != nil {
+			return errors.Wrapf(err, "txn out %d", k)
+		}
+		if address := LockAddress(lock); out.Address != address {
+			return fmt.Errorf("txn out %d address must be %s for its lock", k, address)
 		}
 	}
-	return newUnspent
+	return nil
 }
 
-func findUnspentTxnOut(txnOutID string, txnOutIndex int64, unspent []*TxnOutUnspent) *TxnOutUnspent {
-	for _, u := range unspent {
-		if u.TxnOutID == txnOutID && u.TxnOutIndex == txnOutIndex {
-			return u
-		}
+// validateTxnOutAddress checks the address of a txn out without a lock could be spent from i.e. it is a pub key hash
+// address or a base64 public key.
+func validateTxnOutAddress(address string) error {
+	if _, err := crypto.DecodeAddress(address); err == nil {
+		return nil
+	}
+	if _, err := crypto.PubKeyFromBase64(address); err != nil {
+		return fmt.Errorf("address %s was not a valid address or public key", address)
 	}
 	return nil
 }
 
-func getTxnInAmount(txnIn *TxnIn, unspent []*TxnOutUnspent) (int64, error) {
-	rec := findUnspentTxnOut(txnIn.TxnOutID, txnIn.TxnOutIndex, unspent)
+// totalTxnOutValue sums the txn outs which must all be positive.
+func totalTxnOutValue(txn *Transaction) (int64, error) {
+	total := int64(0)
+	for k, out := range txn.TxnOut {
+		if out == nil || out.Amount <= 0 {
+			return 0, fmt.Errorf("txn id %s txn out %d did not have a positive amount", txn.ID, k)
+		}
+		if total+out.Amount < total {
+			return 0, fmt.Errorf("txn id %s total out value overflowed", txn.ID)
+		}
+		total += out.Amount
+	}
+	return total, nil
+}
+
+func getTxnInAmount(txnIn *TxnIn, unspent *TxnOutUnspentSet) (int64, error) {
+	rec := unspent.Get(txnIn.TxnOutID, txnIn.TxnOutIndex)
 	if rec == nil {
 		return 0, fmt.Errorf("failed to locate referenced unspent txn out")
 	}
@@ -254,23 +603,14 @@ func getTxnInAmount(txnIn *TxnIn, unspent []*TxnOutUnspent) (int64, error) {
 }
 
 func validateTxnInSets(txns []*Transaction) error {
-	index := make(map[string]struct{})
+	index := make(map[TxnOutRef]struct{})
 	for _, t := range txns {
 		for _, sp := range t.TxnIn.Spent() {
-			if _, found := index[sp.TxnOutID]; found {
-				return fmt.Errorf("same txn out id was found in two different txn in records: %s", sp.TxnOutID)
+			if _, found := index[sp]; found {
+				return fmt.Errorf("same txn out was found in two different txn in records: %s/%d", sp.TxnOutID, sp.TxnOutIndex)
 			}
-			index[sp.TxnOutID] = struct{}{}
+			index[sp] = struct{}{}
 		}
 	}
 	return nil
 }
-
-func isSpent(unspent []*TxnOutSpent, outId string, outIndex int64) bool {
-	for _, u := range unspent {
-		if u.TxnOutID == outId && u.TxnOutIndex == outIndex {
-			return true
-		}
-	}
-	return false
-}
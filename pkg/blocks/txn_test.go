@@ -0,0 +1,195 @@
+package blocks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/warmans/catbux/pkg/crypto"
+)
+
+// testAddress is a pub key hash address derived from name.
+func testAddress(name string) string {
+	d := sha256.Sum256([]byte(name))
+	x, y := elliptic.P256().ScalarBaseMult(d[:])
+	return crypto.PubKeyToAddress(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y})
+}
+
+func testKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// testMultiInputTxn creates a transaction spending three txn outs: two paid to the first key's public key and one
+// paid to the second key's short address. It is returned unsigned along with the unspent set it spends from.
+func testMultiInputTxn(t *testing.T, first, second *ecdsa.PrivateKey) (*Transaction, *TxnOutUnspentSet) {
+	firstAddress, err := crypto.PubKeyToBase64(&first.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unspent := NewTxnOutUnspentSet()
+	unspent.Add(&TxnOutUnspent{TxnOutID: "funding-1", TxnOutIndex: 0, Address: firstAddress, Amount: 10})
+	unspent.Add(&TxnOutUnspent{TxnOutID: "funding-1", TxnOutIndex: 1, Address: firstAddress, Amount: 20})
+	unspent.Add(&TxnOutUnspent{TxnOutID: "funding-2", TxnOutIndex: 0, Address: crypto.PubKeyToAddress(&second.PublicKey), Amount: 30})
+
+	txn := &Transaction{Version: CurrentTxnVersion, TxnOut: []*TxnOut{{Address: testAddress("receiver"), Amount: 55}, {Address: firstAddress, Amount: 4}}}
+	txn.TxnIn.Append(&TxnIn{TxnOutID: "funding-1", TxnOutIndex: 0})
+	txn.TxnIn.Append(&TxnIn{TxnOutID: "funding-1", TxnOutIndex: 1})
+	txn.TxnIn.Append(&TxnIn{TxnOutID: "funding-2", TxnOutIndex: 0, PubKey: hex.EncodeToString(crypto.CompressPubKey(&second.PublicKey))})
+	txn.ID = GetTransactionID(txn)
+	return txn, unspent
+}
+
+func signAll(t *testing.T, txn *Transaction, unspent *TxnOutUnspentSet, keys ...*ecdsa.PrivateKey) {
+	for k, key := range keys {
+		in, err := txn.GetTxnIn(int64(k))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if in.Signature, err = SignTxnIn(txn, int64(k), key, unspent); err != nil {
+			t.Fatalf("failed to sign txn in %d: %s", k, err)
+		}
+	}
+}
+
+func TestSignMultiInputTxn(t *testing.T) {
+	first := testKey(t)
+	second := testKey(t)
+	txn, unspent := testMultiInputTxn(t, first, second)
+	signAll(t, txn, unspent, first, first, second)
+
+	fee, err := txn.Fee(unspent)
+	if err != nil {
+		t.Fatalf("expected signed txn to be valid: %s", err)
+	}
+	if fee != 1 {
+		t.Fatalf("expected fee of 1 got %d", fee)
+	}
+}
+
+func TestSignTxnInRejectsWrongKey(t *testing.T) {
+	first := testKey(t)
+	second := testKey(t)
+	txn, unspent := testMultiInputTxn(t, first, second)
+
+	if _, err := SignTxnIn(txn, 2, first, unspent); err == nil {
+		t.Fatal("expected signing with a key that does not own the txn out to fail")
+	}
+}
+
+func TestValidateMultiInputTxnRejectsTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(t *testing.T, txn *Transaction, unspent *TxnOutUnspentSet)
+		err    string
+	}{
+		{
+			name: "signatures swapped between inputs with the same key",
+			tamper: func(t *testing.T, txn *Transaction, unspent *TxnOutUnspentSet) {
+				a, _ := txn.GetTxnIn(0)
+				b, _ := txn.GetTxnIn(1)
+				a.Signature, b.Signature = b.Signature, a.Signature
+			},
+			err: "failed to verify signature",
+		},
+		{
+			name: "signature copied from another input",
+			tamper: func(t *testing.T, txn *Transaction, unspent *TxnOutUnspentSet) {
+				a, _ := txn.GetTxnIn(0)
+				b, _ := txn.GetTxnIn(1)
+				b.Signature = a.Signature
+			},
+			err: "failed to verify signature",
+		},
+		{
+			name: "output address changed",
+			tamper: func(t *testing.T, txn *Transaction, unspent *TxnOutUnspentSet) {
+				txn.TxnOut[0].Address = testAddress("thief")
+			},
+			err: "invalid transaction ID",
+		},
+		{
+			name: "output address changed and ID recalculated",
+			tamper: func(t *testing.T, txn *Transaction, unspent *TxnOutUnspentSet) {
+				txn.TxnOut[0].Address = testAddress("thief")
+				txn.ID = GetTransactionID(txn)
+			},
+			err: "failed to verify signature",
+		},
+		{
+			name: "output amount changed and ID recalculated",
+			tamper: func(t *testing.T, txn *Transaction, unspent *TxnOutUnspentSet) {
+				txn.TxnOut[0].Amount, txn.TxnOut[1].Amount = 50, 9
+				txn.ID = GetTransactionID(txn)
+			},
+			err: "failed to verify signature",
+		},
+		{
+			name: "spent amount differs from the one signed",
+			tamper: func(t *testing.T, txn *Transaction, unspent *TxnOutUnspentSet) {
+				spent := *unspent.Get("funding-1", 1)
+				spent.Amount = 25
+				unspent.Add(&spent)
+			},
+			err: "failed to verify signature",
+		},
+		{
+			name: "pub key replaced",
+			tamper: func(t *testing.T, txn *Transaction, unspent *TxnOutUnspentSet) {
+				other := testKey(t)
+				in, _ := txn.GetTxnIn(2)
+				in.PubKey = hex.EncodeToString(crypto.CompressPubKey(&other.PublicKey))
+			},
+			err: "pub key did not match address",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			first := testKey(t)
+			second := testKey(t)
+			txn, unspent := testMultiInputTxn(t, first, second)
+			signAll(t, txn, unspent, first, first, second)
+
+			test.tamper(t, txn, unspent)
+
+			err := txn.Validate(unspent)
+			if err == nil {
+				t.Fatal("expected tampered txn to be invalid")
+			}
+			if !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q got %q", test.err, err.Error())
+			}
+		})
+	}
+}
+
+func TestInvalidTxnOutAddress(t *testing.T) {
+	key := testKey(t)
+	for _, address := range []string{"AAAA", "receiver", "", testAddress("receiver")[1:]} {
+		t.Run("pay to "+address, func(t *testing.T) {
+			txn, unspent := testMultiInputTxn(t, key, testKey(t))
+			txn.TxnOut[0].Address = address
+			txn.ID = GetTransactionID(txn)
+			if err := txn.Validate(unspent); err == nil || !strings.Contains(err.Error(), "not a valid address") {
+				t.Fatalf("expected invalid address to be rejected got %v", err)
+			}
+		})
+		t.Run("spend from "+address, func(t *testing.T) {
+			// txn outs with invalid addresses may already be in the chain from before addresses were validated
+			unspent := NewTxnOutUnspentSet()
+			unspent.Add(&TxnOutUnspent{TxnOutID: "garbage", TxnOutIndex: 0, Address: address, Amount: 10})
+			txn := &Transaction{Version: CurrentTxnVersion, TxnOut: []*TxnOut{{Address: testAddress("receiver"), Amount: 10}}}
+			txn.TxnIn.Append(&TxnIn{TxnOutID: "garbage", TxnOutIndex: 0, Signature: "AAAA"})
+			txn.ID = GetTransactionID(txn)
+			if err := txn.Validate(unspent); err == nil {
+				t.Fatal("expected spend to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package blocks
+
+import (
+	"sort"
+	"sync"
+)
+
+// TxnOutRef identifies a single txn out by the ID of the transaction that created it and its position in that
+// transaction's outputs.
+type TxnOutRef struct {
+	TxnOutID    string `json:"txn_out_id"`
+	TxnOutIndex int64  `json:"txn_out_index"`
+}
+
+// TxnOutUnspentDelta records the changes made to a TxnOutUnspentSet when a block's transactions were applied so that
+// they can be rolled back.
+type TxnOutUnspentDelta struct {
+	Spent   []*TxnOutUnspent
+	Created []TxnOutRef
+}
+
+func NewTxnOutUnspentSet() *TxnOutUnspentSet {
+	return &TxnOutUnspentSet{
+		outs:      make(map[TxnOutRef]*TxnOutUnspent),
+		byAddress: make(map[string]map[TxnOutRef]struct{}),
+	}
+}
+
+// TxnOutUnspentSet is the set of unspent txn outs indexed by TxnOutRef with a secondary index by address.
+type TxnOutUnspentSet struct {
+	mu        sync.RWMutex
+	outs      map[TxnOutRef]*TxnOutUnspent
+	byAddress map[string]map[TxnOutRef]struct{}
+}
+
+// Get returns the unspent txn out with the given ID and index or nil if it does not exist (or was spent).
+func (s *TxnOutUnspentSet) Get(txnOutID string, txnOutIndex int64) *TxnOutUnspent {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.outs[TxnOutRef{TxnOutID: txnOutID, TxnOutIndex: txnOutIndex}]
+}
+
+func (s *TxnOutUnspentSet) Len() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return int64(len(s.outs))
+}
+
+// ForAddress returns all unspent txn outs paid to the given address ordered by ID and index.
+func (s *TxnOutUnspentSet) ForAddress(address string) []*TxnOutUnspent {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := make([]*TxnOutUnspent, 0, len(s.byAddress[address]))
+	for ref := range s.byAddress[address] {
+		res = append(res, s.outs[ref])
+	}
+	sortTxnOutUnspent(res)
+	return res
+}
+
+// All returns every unspent txn out ordered by ID and index.
+func (s *TxnOutUnspentSet) All() []*TxnOutUnspent {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := make([]*TxnOutUnspent, 0, len(s.outs))
+	for _, u := range s.outs {
+		res = append(res, u)
+	}
+	sortTxnOutUnspent(res)
+	return res
+}
+
+func (s *TxnOutUnspentSet) Copy() *TxnOutUnspentSet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c := NewTxnOutUnspentSet()
+	for _, u := range s.outs {
+		c.add(u)
+	}
+	return c
+}
+
+// Add inserts an unspent txn out e.g. when rebuilding a partial set from data returned by a node.
+func (s *TxnOutUnspentSet) Add(u *TxnOutUnspent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.add(u)
+}
+
+// Apply removes all txn outs spent by the given transactions and adds the txn outs they create at the given block
+// height. Transactions must already have been validated. The returned delta can be passed to Rollback to undo the
+// change.
+func (s *TxnOutUnspentSet) Apply(txns []*Transaction, height int64) *TxnOutUnspentDelta {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delta := &TxnOutUnspentDelta{Spent: []*TxnOutUnspent{}, Created: []TxnOutRef{}}
+	for _, txn := range txns {
+		for _, ref := range txn.TxnIn.Spent() {
+			if u := s.remove(ref); u != nil {
+				delta.Spent = append(delta.Spent, u)
+			}
+		}
+	}
+	for _, txn := range txns {
+		for i, out := range txn.TxnOut {
+			u := &TxnOutUnspent{TxnOutID: txn.ID, TxnOutIndex: int64(i), Address: out.Address, Amount: out.Amount, Height: height, Lock: out.Lock}
+			s.add(u)
+			delta.Created = append(delta.Created, TxnOutRef{TxnOutID: u.TxnOutID, TxnOutIndex: u.TxnOutIndex})
+		}
+	}
+	return delta
+}
+
+// Rollback reverts a change previously made by Apply. Deltas must be rolled back in reverse order.
+func (s *TxnOutUnspentSet) Rollback(delta *TxnOutUnspentDelta) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ref := range delta.Created {
+		s.remove(ref)
+	}
+	for _, u := range delta.Spent {
+		s.add(u)
+	}
+}
+
+func (s *TxnOutUnspentSet) add(u *TxnOutUnspent) {
+	ref := TxnOutRef{TxnOutID: u.TxnOutID, TxnOutIndex: u.TxnOutIndex}
+	s.outs[ref] = u
+	if _, ok := s.byAddress[u.Address]; !ok {
+		s.byAddress[u.Address] = make(map[TxnOutRef]struct{})
+	}
+	s.byAddress[u.Address][ref] = struct{}{}
+}
+
+func (s *TxnOutUnspentSet) remove(ref TxnOutRef) *TxnOutUnspent {
+	u, ok := s.outs[ref]
+	if !ok {
+		return nil
+	}
+	delete(s.outs, ref)
+	delete(s.byAddress[u.Address], ref)
+	if len(s.byAddress[u.Address]) == 0 {
+		delete(s.byAddress, u.Address)
+	}
+	return u
+}
+
+func sortTxnOutUnspent(unspent []*TxnOutUnspent) {
+	sort.Slice(unspent, func(i, j int) bool {
+		if unspent[i].TxnOutID != unspent[j].TxnOutID {
+			return unspent[i].TxnOutID < unspent[j].TxnOutID
+		}
+		return unspent[i].TxnOutIndex < unspent[j].TxnOutIndex
+	})
+}
@@ -0,0 +1,236 @@
+package blocks
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// benchUnspentSize is the number of unspent txn outs the benchmarks run against.
+const benchUnspentSize = 50000
+
+// sliceFindUnspentTxnOut and sliceUpdateUnspentTxns are the slice scans TxnOutUnspentSet replaced, kept here to
+// compare against.
+func sliceFindUnspentTxnOut(txnOutID string, txnOutIndex int64, unspent []*TxnOutUnspent) *TxnOutUnspent {
+	for _, u := range unspent {
+		if u.TxnOutID == txnOutID && u.TxnOutIndex == txnOutIndex {
+			return u
+		}
+	}
+	return nil
+}
+
+func sliceUpdateUnspentTxns(newTxns []*Transaction, unspent []*TxnOutUnspent) []*TxnOutUnspent {
+	spent := make([]TxnOutRef, 0)
+	for _, txn := range newTxns {
+		spent = append(spent, txn.TxnIn.Spent()...)
+	}
+	newUnspent := make([]*TxnOutUnspent, 0)
+	for _, u := range unspent {
+		if !sliceIsSpent(spent, u.TxnOutID, u.TxnOutIndex) {
+			newUnspent = append(newUnspent, u)
+		}
+	}
+	for _, txn := range newTxns {
+		for i, out := range txn.TxnOut {
+			newUnspent = append(newUnspent, &TxnOutUnspent{TxnOutID: txn.ID, TxnOutIndex: int64(i), Address: out.Address, Amount: out.Amount})
+		}
+	}
+	return newUnspent
+}
+
+func sliceIsSpent(spent []TxnOutRef, outID string, outIndex int64) bool {
+	for _, s := range spent {
+		if s.TxnOutID == outID && s.TxnOutIndex == outIndex {
+			return true
+		}
+	}
+	return false
+}
+
+func sliceForAddress(address string, unspent []*TxnOutUnspent) []*TxnOutUnspent {
+	res := make([]*TxnOutUnspent, 0)
+	for _, u := range unspent {
+		if u.Address == address {
+			res = append(res, u)
+		}
+	}
+	return res
+}
+
+func testUnspent(n int) []*TxnOutUnspent {
+	unspent := make([]*TxnOutUnspent, n)
+	for k := range unspent {
+		unspent[k] = &TxnOutUnspent{
+			TxnOutID:    fmt.Sprintf("txn-%d", k/2),
+			TxnOutIndex: int64(k % 2),
+			Address:     fmt.Sprintf("address-%d", k%100),
+			Amount:      int64(k),
+			Height:      int64(k / 10),
+		}
+	}
+	return unspent
+}
+
+func testUnspentSet(unspent []*TxnOutUnspent) *TxnOutUnspentSet {
+	set := NewTxnOutUnspentSet()
+	for _, u := range unspent {
+		set.Add(u)
+	}
+	return set
+}
+
+// testSpendingTxns creates n transactions that each spend one of the given txn outs and create two new ones.
+func testSpendingTxns(unspent []*TxnOutUnspent, n int) []*Transaction {
+	txns := make([]*Transaction, n)
+	for k := range txns {
+		spend := unspent[(k*7919)%len(unspent)]
+		txn := &Transaction{
+			ID:     fmt.Sprintf("spend-%d", k),
+			TxnOut: []*TxnOut{{Address: "address-new", Amount: 1}, {Address: spend.Address, Amount: spend.Amount - 1}},
+		}
+		txn.TxnIn.Append(&TxnIn{TxnOutID: spend.TxnOutID, TxnOutIndex: spend.TxnOutIndex})
+		txns[k] = txn
+	}
+	return txns
+}
+
+func TestTxnOutUnspentSetApplyRollback(t *testing.T) {
+	unspent := testUnspent(1000)
+	set := testUnspentSet(unspent)
+	before := set.All()
+
+	txns := testSpendingTxns(unspent, 10)
+	delta := set.Apply(txns, 200)
+
+	if len(delta.Spent) != 10 || len(delta.Created) != 20 {
+		t.Fatalf("expected 10 spent and 20 created, got %d and %d", len(delta.Spent), len(delta.Created))
+	}
+	if got := set.Len(); got != 1010 {
+		t.Fatalf("expected 1010 unspent after apply, got %d", got)
+	}
+	for _, txn := range txns {
+		for _, ref := range txn.TxnIn.Spent() {
+			if set.Get(ref.TxnOutID, ref.TxnOutIndex) != nil {
+				t.Fatalf("txn out %s:%d was still unspent after apply", ref.TxnOutID, ref.TxnOutIndex)
+			}
+		}
+		created := set.Get(txn.ID, 1)
+		if created == nil {
+			t.Fatalf("txn out %s:1 was not created", txn.ID)
+		}
+		if created.Height != 200 || created.Amount != txn.TxnOut[1].Amount {
+			t.Fatalf("created txn out had wrong height or amount: %+v", created)
+		}
+	}
+	if got := len(set.ForAddress("address-new")); got != 10 {
+		t.Fatalf("expected 10 txn outs for new address, got %d", got)
+	}
+
+	set.Rollback(delta)
+
+	if !reflect.DeepEqual(set.All(), before) {
+		t.Fatal("unspent set was not restored by rollback")
+	}
+	if got := set.ForAddress("address-new"); len(got) != 0 {
+		t.Fatalf("expected no txn outs for new address after rollback, got %d", len(got))
+	}
+}
+
+func TestTxnOutUnspentSetRollbackInReverseOrder(t *testing.T) {
+	set := testUnspentSet(testUnspent(10))
+	before := set.All()
+
+	// the second block spends an output created by the first
+	first := testSpendingTxns(set.All(), 1)
+	firstDelta := set.Apply(first, 20)
+	second := &Transaction{ID: "spend-created", TxnOut: []*TxnOut{{Address: "address-other", Amount: 1}}}
+	second.TxnIn.Append(&TxnIn{TxnOutID: first[0].ID, TxnOutIndex: 0})
+	secondDelta := set.Apply([]*Transaction{second}, 21)
+
+	if set.Get(first[0].ID, 0) != nil {
+		t.Fatal("output created by first block was not spent by second")
+	}
+
+	set.Rollback(secondDelta)
+	if set.Get(first[0].ID, 0) == nil {
+		t.Fatal("output created by first block was not restored by rolling back the second")
+	}
+	set.Rollback(firstDelta)
+
+	if !reflect.DeepEqual(set.All(), before) {
+		t.Fatal("unspent set was not restored by rollback")
+	}
+}
+
+func TestTxnOutUnspentSetApplyMatchesSlice(t *testing.T) {
+	unspent := testUnspent(1000)
+	set := testUnspentSet(unspent)
+	txns := testSpendingTxns(unspent, 50)
+
+	set.Apply(txns, 0)
+	expected := sliceUpdateUnspentTxns(txns, unspent)
+	sortTxnOutUnspent(expected)
+
+	if !reflect.DeepEqual(set.All(), expected) {
+		t.Fatal("applying to set gave a different result to the slice scan")
+	}
+}
+
+func BenchmarkFindUnspentTxnOutSlice(b *testing.B) {
+	unspent := testUnspent(benchUnspentSize)
+	b.ResetTimer()
+	for k := 0; k < b.N; k++ {
+		u := unspent[(k*7919)%len(unspent)]
+		if sliceFindUnspentTxnOut(u.TxnOutID, u.TxnOutIndex, unspent) == nil {
+			b.Fatal("txn out not found")
+		}
+	}
+}
+
+func BenchmarkFindUnspentTxnOutSet(b *testing.B) {
+	unspent := testUnspent(benchUnspentSize)
+	set := testUnspentSet(unspent)
+	b.ResetTimer()
+	for k := 0; k < b.N; k++ {
+		u := unspent[(k*7919)%len(unspent)]
+		if set.Get(u.TxnOutID, u.TxnOutIndex) == nil {
+			b.Fatal("txn out not found")
+		}
+	}
+}
+
+func BenchmarkApplyBlockSlice(b *testing.B) {
+	unspent := testUnspent(benchUnspentSize)
+	txns := testSpendingTxns(unspent, 100)
+	b.ResetTimer()
+	for k := 0; k < b.N; k++ {
+		sliceUpdateUnspentTxns(txns, unspent)
+	}
+}
+
+func BenchmarkApplyBlockSet(b *testing.B) {
+	unspent := testUnspent(benchUnspentSize)
+	set := testUnspentSet(unspent)
+	txns := testSpendingTxns(unspent, 100)
+	b.ResetTimer()
+	for k := 0; k < b.N; k++ {
+		set.Rollback(set.Apply(txns, 0))
+	}
+}
+
+func BenchmarkForAddressSlice(b *testing.B) {
+	unspent := testUnspent(benchUnspentSize)
+	b.ResetTimer()
+	for k := 0; k < b.N; k++ {
+		sliceForAddress(fmt.Sprintf("address-%d", k%100), unspent)
+	}
+}
+
+func BenchmarkForAddressSet(b *testing.B) {
+	set := testUnspentSet(testUnspent(benchUnspentSize))
+	b.ResetTimer()
+	for k := 0; k < b.N; k++ {
+		set.ForAddress(fmt.Sprintf("address-%d", k%100))
+	}
+}
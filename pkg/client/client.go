@@ -0,0 +1,121 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/warmans/catbux/pkg/blocks"
+)
+
+func New(nodeAddr string) *Client {
+	if !strings.HasPrefix(nodeAddr, "http://") && !strings.HasPrefix(nodeAddr, "https://") {
+		nodeAddr = "http://" + nodeAddr
+	}
+	return &Client{addr: strings.TrimSuffix(nodeAddr, "/"), http: &http.Client{Timeout: time.Minute}}
+}
+
+// Client talks to a node's HTTP API.
+type Client struct {
+	addr string
+	http *http.Client
+}
+
+// Blocks returns the node's full chain.
+func (c *Client) Blocks() (json.RawMessage, error) {
+	res := json.RawMessage{}
+	return res, c.do(http.MethodGet, "/blocks", nil, &res)
+}
+
+// Peers returns the members of the node's cluster.
+func (c *Client) Peers() (json.RawMessage, error) {
+	res := json.RawMessage{}
+	return res, c.do(http.MethodGet, "/peers", nil, &res)
+}
+
+// Mine asks the node to mine a new block and returns the resulting chain.
+func (c *Client) Mine() (json.RawMessage, error) {
+	res := json.RawMessage{}
+	return res, c.do(http.MethodGet, "/mine", nil, &res)
+}
+
+// StartMining asks the node to start mining blocks in the background.
+func (c *Client) StartMining() (json.RawMessage, error) {
+	res := json.RawMessage{}
+	return res, c.do(http.MethodPost, "/mine/start", nil, &res)
+}
+
+// StopMining asks the node to stop mining blocks in the background.
+func (c *Client) StopMining() (json.RawMessage, error) {
+	res := json.RawMessage{}
+	return res, c.do(http.MethodPost, "/mine/stop", nil, &res)
+}
+
+// MiningStatus returns the state of the node's background mining.
+func (c *Client) MiningStatus() (json.RawMessage, error) {
+	res := json.RawMessage{}
+	return res, c.do(http.MethodGet, "/mine/status", nil, &res)
+}
+
+// TransactionProof returns a Merkle proof that the transaction is on the node's main chain.
+func (c *Client) TransactionProof(id string) (json.RawMessage, error) {
+	res := json.RawMessage{}
+	return res, c.do(http.MethodGet, "/transactions/"+url.PathEscape(id)+"/proof", nil, &res)
+}
+
+// Unspent returns the unspent txn outs paid to the given address.
+func (c *Client) Unspent(address string) (*blocks.TxnOutUnspentSet, error) {
+	res := []*blocks.TxnOutUnspent{}
+	if err := c.do(http.MethodGet, "/unspent?address="+url.QueryEscape(address), nil, &res); err != nil {
+		return nil, err
+	}
+	set := blocks.NewTxnOutUnspentSet()
+	for _, u := range res {
+		set.Add(u)
+	}
+	return set, nil
+}
+
+// PendingTransactions returns the transactions in the node's pool.
+func (c *Client) PendingTransactions() ([]*blocks.Transaction, error) {
+	res := []*blocks.Transaction{}
+	return res, c.do(http.MethodGet, "/transactions", nil, &res)
+}
+
+// SubmitTransaction adds a signed transaction to the node's pool.
+func (c *Client) SubmitTransaction(txn *blocks.Transaction) error {
+	return c.do(http.MethodPost, "/transactions", txn, nil)
+}
+
+func (c *Client) do(method string, path string, body interface{}, target interface{}) error {
+	reqBody := &bytes.Buffer{}
+	if body != nil {
+		if err := json.NewEncoder(reqBody).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, c.addr+path, reqBody)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "request failed")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("node returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if target == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(target)
+}
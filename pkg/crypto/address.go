@@ -0,0 +1,114 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+)
+
+// Addresses are the base58 encoding of a version byte, the hash of a compressed public key and a checksum (i.e.
+// base58check). They are much shorter than the base64 encoded PEM public keys used by PubKeyToBase64 and the checksum
+// catches typos. The public key itself is only revealed when spending from the address.
+const (
+	// AddressVersion is the first byte of an address. It makes every address start with a C.
+	AddressVersion byte = 0x1c
+	// PubKeyHashSize is the number of bytes of the public key hash in an address.
+	PubKeyHashSize = 20
+
+	addressChecksumSize = 4
+	addressSize         = 1 + PubKeyHashSize + addressChecksumSize
+)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// CompressPubKey encodes the public key as its X coordinate and the sign of its Y coordinate.
+func CompressPubKey(key *ecdsa.PublicKey) []byte {
+	return elliptic.MarshalCompressed(key.Curve, key.X, key.Y)
+}
+
+// DecompressPubKey decodes a P-256 public key encoded by CompressPubKey.
+func DecompressPubKey(data []byte) (*ecdsa.PublicKey, error) {
+	x, y := elliptic.UnmarshalCompressed(elliptic.P256(), data)
+	if x == nil {
+		return nil, fmt.Errorf("invalid compressed public key")
+	}
+	return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+}
+
+// PubKeyHash is the hash of the compressed public key used in addresses.
+func PubKeyHash(key *ecdsa.PublicKey) []byte {
+	digest := sha256.Sum256(CompressPubKey(key))
+	return digest[:PubKeyHashSize]
+}
+
+// PubKeyToAddress returns the address of the public key.
+func PubKeyToAddress(key *ecdsa.PublicKey) string {
+	payload := append([]byte{AddressVersion}, PubKeyHash(key)...)
+	return base58Encode(append(payload, addressChecksum(payload)...))
+}
+
+// DecodeAddress checks the address's version and checksum and returns the public key hash it contains.
+func DecodeAddress(address string) ([]byte, error) {
+	decoded, err := base58Decode(address)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) != addressSize {
+		return nil, fmt.Errorf("address was %d bytes but expected %d", len(decoded), addressSize)
+	}
+	payload, checksum := decoded[:addressSize-addressChecksumSize], decoded[addressSize-addressChecksumSize:]
+	if payload[0] != AddressVersion {
+		return nil, fmt.Errorf("address version %d is not known", payload[0])
+	}
+	if !bytes.Equal(checksum, addressChecksum(payload)) {
+		return nil, fmt.Errorf("address checksum did not match (check for typos)")
+	}
+	return payload[1:], nil
+}
+
+func addressChecksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	return second[:addressChecksumSize]
+}
+
+// base58Encode encodes the data as a big endian number in base58. Leading zero bytes are each encoded as a 1.
+func base58Encode(data []byte) string {
+	n := new(big.Int).SetBytes(data)
+	base, mod := big.NewInt(int64(len(base58Alphabet))), new(big.Int)
+	encoded := []byte{}
+	for n.Sign() > 0 {
+		n.DivMod(n, base, mod)
+		encoded = append(encoded, base58Alphabet[mod.Int64()])
+	}
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		encoded = append(encoded, base58Alphabet[0])
+	}
+	for i, j := 0, len(encoded)-1; i < j; i, j = i+1, j-1 {
+		encoded[i], encoded[j] = encoded[j], encoded[i]
+	}
+	return string(encoded)
+}
+
+func base58Decode(encoded string) ([]byte, error) {
+	n, base := new(big.Int), big.NewInt(int64(len(base58Alphabet)))
+	zeros := 0
+	for k := 0; k < len(encoded); k++ {
+		digit := bytes.IndexByte([]byte(base58Alphabet), encoded[k])
+		if digit == -1 {
+			return nil, fmt.Errorf("address contained invalid character %q at %d", encoded[k], k)
+		}
+		if digit == 0 && zeros == k {
+			zeros++
+		}
+		n.Mul(n, base)
+		n.Add(n, big.NewInt(int64(digit)))
+	}
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
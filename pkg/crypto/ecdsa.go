@@ -2,6 +2,7 @@ package crypto
 
 import (
 	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/x509"
@@ -10,8 +11,24 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+
+	"golang.org/x/crypto/ssh"
 )
 
+// GenerateKey creates a new P-256 ECDSA private key.
+func GenerateKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// PubKeyToBase64 encodes a public key in the address format understood by PubKeyFromBase64.
+func PubKeyToBase64(key *ecdsa.PublicKey) (string, error) {
+	encoded, err := EncodePublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(encoded), nil
+}
+
 func PubKeyFromBase64(encoded string) (*ecdsa.PublicKey, error) {
 	signatureBytes, err := base64.URLEncoding.DecodeString(encoded)
 	if err != nil {
@@ -27,8 +44,11 @@ func PubKeyFromBase64(encoded string) (*ecdsa.PublicKey, error) {
 // DecodePublicKey decodes a PEM-encoded ECDSA public key.
 func DecodePublicKey(encodedKey []byte) (*ecdsa.PublicKey, error) {
 	block, _ := pem.Decode(encodedKey)
-	if block == nil || block.Type != "PUBLIC KEY" {
-		return nil, fmt.Errorf("marshal: could not decode PEM block type %s", block.Type)
+	if block == nil {
+		return nil, errors.New("marshal: could not decode PEM block")
+	}
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("marshal: unsupported PEM block type %s", block.Type)
 	}
 
 	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
@@ -59,6 +79,54 @@ func EncodePublicKey(key *ecdsa.PublicKey) ([]byte, error) {
 	return pem.EncodeToMemory(block), nil
 }
 
+// DecodePrivateKey decodes a PEM-encoded ECDSA private key. SEC 1 ("EC PRIVATE KEY"), PKCS #8 ("PRIVATE KEY") and
+// unencrypted OpenSSH ("OPENSSH PRIVATE KEY", as produced by ssh-keygen -o) encodings are supported.
+func DecodePrivateKey(encodedKey []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(encodedKey)
+	if block == nil {
+		return nil, errors.New("marshal: could not decode PEM block")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "OPENSSH PRIVATE KEY":
+		key, err = ssh.ParseRawPrivateKey(encodedKey)
+	default:
+		return nil, fmt.Errorf("marshal: unsupported PEM block type %s", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		return k, nil
+	case ecdsa.PrivateKey:
+		return &k, nil
+	}
+	return nil, errors.New("marshal: data was not an ECDSA private key")
+}
+
+// EncodePrivateKey encodes an ECDSA private key to PEM format.
+func EncodePrivateKey(key *ecdsa.PrivateKey) ([]byte, error) {
+	derBytes, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	block := &pem.Block{
+		Type:  "EC PRIVATE KEY",
+		Bytes: derBytes,
+	}
+
+	return pem.EncodeToMemory(block), nil
+}
+
 // Sign signs arbitrary data using ECDSA.
 func Sign(data []byte, privkey *ecdsa.PrivateKey) ([]byte, error) {
 	// hash message
@@ -89,6 +157,9 @@ func Verify(data, signature []byte, pubkey *ecdsa.PublicKey) bool {
 	digest := sha256.Sum256(data)
 
 	curveOrderByteSize := pubkey.Curve.Params().P.BitLen() / 8
+	if len(signature) != curveOrderByteSize*2 {
+		return false
+	}
 
 	r, s := new(big.Int), new(big.Int)
 	r.SetBytes(signature[:curveOrderByteSize])
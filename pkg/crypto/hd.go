@@ -0,0 +1,123 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Hierarchical deterministic keys are derived from a seed as per SLIP-0010, which applies BIP32 to the NIST P-256
+// curve. Invalid keys (which are astronomically unlikely) are skipped by re-hashing rather than failing.
+
+// HardenedKeyStart is the first hardened child index. Hardened children can only be derived from the parent's
+// private key.
+const HardenedKeyStart uint32 = 0x80000000
+
+var hdMasterSecret = []byte("Nist256p1 seed")
+
+// ExtendedKey is a private key along with the chain code used to derive its children.
+type ExtendedKey struct {
+	Key       *ecdsa.PrivateKey
+	ChainCode []byte
+	Depth     uint8
+}
+
+// NewMasterKey derives the root key from a seed e.g. one created from a mnemonic.
+func NewMasterKey(seed []byte) (*ExtendedKey, error) {
+	if len(seed) < 16 || len(seed) > 64 {
+		return nil, fmt.Errorf("seed must be between 16 and 64 bytes (got %d)", len(seed))
+	}
+	data := seed
+	for {
+		sum := hmacSHA512(hdMasterSecret, data)
+		if key := privateKeyFromScalar(new(big.Int).SetBytes(sum[:32])); key != nil {
+			return &ExtendedKey{Key: key, ChainCode: sum[32:]}, nil
+		}
+		data = sum
+	}
+}
+
+// Child derives the child key at the given index. Indexes from HardenedKeyStart onwards derive hardened children.
+func (k *ExtendedKey) Child(index uint32) (*ExtendedKey, error) {
+	if k.Depth == 255 {
+		return nil, fmt.Errorf("key was already at the maximum depth")
+	}
+	data := make([]byte, 0, 37)
+	if index >= HardenedKeyStart {
+		data = append(data, 0)
+		data = append(data, k.Key.D.FillBytes(make([]byte, 32))...)
+	} else {
+		data = append(data, CompressPubKey(&k.Key.PublicKey)...)
+	}
+	data = binary.BigEndian.AppendUint32(data, index)
+
+	n := k.Key.Curve.Params().N
+	for {
+		sum := hmacSHA512(k.ChainCode, data)
+		tweak := new(big.Int).SetBytes(sum[:32])
+		if tweak.Cmp(n) < 0 {
+			d := tweak.Add(tweak, k.Key.D)
+			if key := privateKeyFromScalar(d.Mod(d, n)); key != nil {
+				return &ExtendedKey{Key: key, ChainCode: sum[32:], Depth: k.Depth + 1}, nil
+			}
+		}
+		data = append([]byte{1}, sum[32:]...)
+		data = binary.BigEndian.AppendUint32(data, index)
+	}
+}
+
+// Derive follows the path of child indexes from the key.
+func (k *ExtendedKey) Derive(path []uint32) (*ExtendedKey, error) {
+	key := k
+	for _, index := range path {
+		var err error
+		if key, err = key.Child(index); err != nil {
+			return nil, err
+		}
+	}
+	return key, nil
+}
+
+// ParseDerivationPath parses a path such as m/0'/1 into child indexes. Hardened indexes are marked with a '.
+func ParseDerivationPath(path string) ([]uint32, error) {
+	parts := strings.Split(path, "/")
+	if parts[0] != "m" {
+		return nil, fmt.Errorf("derivation path must start with m: %s", path)
+	}
+	indexes := make([]uint32, 0, len(parts)-1)
+	for _, part := range parts[1:] {
+		hardened := strings.HasSuffix(part, "'")
+		index, err := strconv.ParseUint(strings.TrimSuffix(part, "'"), 10, 32)
+		if err != nil || uint32(index) >= HardenedKeyStart {
+			return nil, fmt.Errorf("invalid derivation path index: %s", part)
+		}
+		if hardened {
+			index += uint64(HardenedKeyStart)
+		}
+		indexes = append(indexes, uint32(index))
+	}
+	return indexes, nil
+}
+
+// privateKeyFromScalar returns the P-256 key with the given scalar or nil if it is not a valid key.
+func privateKeyFromScalar(d *big.Int) *ecdsa.PrivateKey {
+	curve := elliptic.P256()
+	if d.Sign() == 0 || d.Cmp(curve.Params().N) >= 0 {
+		return nil
+	}
+	key := &ecdsa.PrivateKey{PublicKey: ecdsa.PublicKey{Curve: curve}, D: d}
+	key.PublicKey.X, key.PublicKey.Y = curve.ScalarBaseMult(d.FillBytes(make([]byte, 32)))
+	return key
+}
+
+func hmacSHA512(key []byte, data []byte) []byte {
+	mac := hmac.New(sha512.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
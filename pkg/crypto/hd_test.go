@@ -0,0 +1,181 @@
+package crypto
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+// SLIP-0010 test vectors for the NIST P-256 curve.
+func TestDeriveSLIP10Vectors(t *testing.T) {
+	tests := []struct {
+		seed      string
+		path      string
+		chainCode string
+		key       string
+		pubKey    string
+	}{
+		// test vector 1
+		{
+			seed:      "000102030405060708090a0b0c0d0e0f",
+			path:      "m",
+			chainCode: "beeb672fe4621673f722f38529c07392fecaa61015c80c34f29ce8b41b3cb6ea",
+			key:       "612091aaa12e22dd2abef664f8a01a82cae99ad7441b7ef8110424915c268bc2",
+			pubKey:    "0266874dc6ade47b3ecd096745ca09bcd29638dd52c2c12117b11ed3e458cfa9e8",
+		},
+		{
+			seed:      "000102030405060708090a0b0c0d0e0f",
+			path:      "m/0'",
+			chainCode: "3460cea53e6a6bb5fb391eeef3237ffd8724bf0a40e94943c98b83825342ee11",
+			key:       "6939694369114c67917a182c59ddb8cafc3004e63ca5d3b84403ba8613debc0c",
+			pubKey:    "0384610f5ecffe8fda089363a41f56a5c7ffc1d81b59a612d0d649b2d22355590c",
+		},
+		{
+			seed:      "000102030405060708090a0b0c0d0e0f",
+			path:      "m/0'/1",
+			chainCode: "4187afff1aafa8445010097fb99d23aee9f599450c7bd140b6826ac22ba21d0c",
+			key:       "284e9d38d07d21e4e281b645089a94f4cf5a5a81369acf151a1c3a57f18b2129",
+			pubKey:    "03526c63f8d0b4bbbf9c80df553fe66742df4676b241dabefdef67733e070f6844",
+		},
+		{
+			seed:      "000102030405060708090a0b0c0d0e0f",
+			path:      "m/0'/1/2'",
+			chainCode: "98c7514f562e64e74170cc3cf304ee1ce54d6b6da4f880f313e8204c2a185318",
+			key:       "694596e8a54f252c960eb771a3c41e7e32496d03b954aeb90f61635b8e092aa7",
+			pubKey:    "0359cf160040778a4b14c5f4d7b76e327ccc8c4a6086dd9451b7482b5a4972dda0",
+		},
+		// test vector 2
+		{
+			seed:      "fffcf9f6f3f0edeae7e4e1dedbd8d5d2cfccc9c6c3c0bdbab7b4b1aeaba8a5a29f9c999693908d8a8784817e7b7875726f6c696663605d5a5754514e4b484542",
+			path:      "m",
+			chainCode: "96cd4465a9644e31528eda3592aa35eb39a9527769ce1855beafc1b81055e75d",
+			key:       "eaa31c2e46ca2962227cf21d73a7ef0ce8b31c756897521eb6c7b39796633357",
+			pubKey:    "02c9e16154474b3ed5b38218bb0463e008f89ee03e62d22fdcc8014beab25b48fa",
+		},
+		{
+			seed:      "fffcf9f6f3f0edeae7e4e1dedbd8d5d2cfccc9c6c3c0bdbab7b4b1aeaba8a5a29f9c999693908d8a8784817e7b7875726f6c696663605d5a5754514e4b484542",
+			path:      "m/0",
+			chainCode: "84e9c258bb8557a40e0d041115b376dd55eda99c0042ce29e81ebe4efed9b86a",
+			key:       "d7d065f63a62624888500cdb4f88b6d59c2927fee9e6d0cdff9cad555884df6e",
+			pubKey:    "039b6df4bece7b6c81e2adfeea4bcf5c8c8a6e40ea7ffa3cf6e8494c61a1fc82cc",
+		},
+		// derivation retry (the first child key is invalid)
+		{
+			seed:      "000102030405060708090a0b0c0d0e0f",
+			path:      "m/28578'/33941",
+			chainCode: "9e87fe95031f14736774cd82f25fd885065cb7c358c1edf813c72af535e83071",
+			key:       "092154eed4af83e078ff9b84322015aefe5769e31270f62c3f66c33888335f3a",
+			pubKey:    "0235bfee614c0d5b2cae260000bb1d0d84b270099ad790022c1ae0b2e782efe120",
+		},
+		// seed retry (the first master key is invalid)
+		{
+			seed:      "a7305bc8df8d0951f0cb224c0e95d7707cbdf2c6ce7e8d481fec69c7ff5e9446",
+			path:      "m",
+			chainCode: "7762f9729fed06121fd13f326884c82f59aa95c57ac492ce8c9654e60efd130c",
+			key:       "3b8c18469a4634517d6d0b65448f8e6c62091b45540a1743c5846be55d47d88f",
+			pubKey:    "0383619fadcde31063d8c5cb00dbfe1713f3e6fa169d8541a798752a1c1ca0cb20",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.seed[:8]+" "+test.path, func(t *testing.T) {
+			seed, err := hex.DecodeString(test.seed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			master, err := NewMasterKey(seed)
+			if err != nil {
+				t.Fatalf("failed to create master key: %s", err)
+			}
+			path, err := ParseDerivationPath(test.path)
+			if err != nil {
+				t.Fatalf("failed to parse path: %s", err)
+			}
+			key, err := master.Derive(path)
+			if err != nil {
+				t.Fatalf("failed to derive key: %s", err)
+			}
+			if got := hex.EncodeToString(key.ChainCode); got != test.chainCode {
+				t.Errorf("expected chain code %s got %s", test.chainCode, got)
+			}
+			if got := hex.EncodeToString(key.Key.D.FillBytes(make([]byte, 32))); got != test.key {
+				t.Errorf("expected private key %s got %s", test.key, got)
+			}
+			if got := hex.EncodeToString(CompressPubKey(&key.Key.PublicKey)); got != test.pubKey {
+				t.Errorf("expected public key %s got %s", test.pubKey, got)
+			}
+			if int(key.Depth) != len(path) {
+				t.Errorf("expected depth %d got %d", len(path), key.Depth)
+			}
+		})
+	}
+}
+
+func TestChildMatchesDerive(t *testing.T) {
+	seed, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	master, err := NewMasterKey(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hardened, err := master.Child(HardenedKeyStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	child, err := hardened.Child(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derived, err := master.Derive([]uint32{HardenedKeyStart, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if child.Key.D.Cmp(derived.Key.D) != 0 || hex.EncodeToString(child.ChainCode) != hex.EncodeToString(derived.ChainCode) {
+		t.Fatal("deriving children one at a time gave a different key to Derive")
+	}
+}
+
+func TestNewMasterKeyRejectsBadSeedLength(t *testing.T) {
+	for _, size := range []int{0, 15, 65} {
+		if _, err := NewMasterKey(make([]byte, size)); err == nil {
+			t.Errorf("expected %d byte seed to be rejected", size)
+		}
+	}
+}
+
+func TestParseDerivationPath(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected []uint32
+		invalid  bool
+	}{
+		{path: "m", expected: []uint32{}},
+		{path: "m/44'/0'/0'/0", expected: []uint32{HardenedKeyStart + 44, HardenedKeyStart, HardenedKeyStart, 0}},
+		{path: "m/1'/2/3'", expected: []uint32{HardenedKeyStart + 1, 2, HardenedKeyStart + 3}},
+		{path: "", invalid: true},
+		{path: "44'/0'", invalid: true},
+		{path: "m/", invalid: true},
+		{path: "m/x", invalid: true},
+		{path: "m/2147483648", invalid: true},
+		{path: "m/-1", invalid: true},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			got, err := ParseDerivationPath(test.path)
+			if test.invalid {
+				if err == nil {
+					t.Fatalf("expected path to be invalid, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(got) != len(test.expected) {
+				t.Fatalf("expected %v got %v", test.expected, got)
+			}
+			for k := range got {
+				if got[k] != test.expected[k] {
+					t.Fatalf("expected %v got %v", test.expected, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/warmans/catbux/pkg/blocks"
+)
+
+// miningJob is a block this node is currently mining on top of prevHash.
+type miningJob struct {
+	prevHash string
+	cancel   context.CancelFunc
+}
+
+// miningJobs tracks blocks being mined so they can be abandoned when the chain tip changes.
+type miningJobs struct {
+	mu   sync.Mutex
+	jobs map[*miningJob]struct{}
+}
+
+// start registers a job mining on top of prevHash. The returned context is cancelled if the tip moves away from
+// prevHash. The returned func must be called once mining finishes.
+func (m *miningJobs) start(ctx context.Context, prevHash string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	job := &miningJob{prevHash: prevHash, cancel: cancel}
+
+	m.mu.Lock()
+	if m.jobs == nil {
+		m.jobs = make(map[*miningJob]struct{})
+	}
+	m.jobs[job] = struct{}{}
+	m.mu.Unlock()
+
+	return ctx, func() {
+		m.mu.Lock()
+		delete(m.jobs, job)
+		m.mu.Unlock()
+		cancel()
+	}
+}
+
+// abortStale cancels any job that is not mining on top of the given tip.
+func (m *miningJobs) abortStale(tipHash string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for job := range m.jobs {
+		if job.prevHash != tipHash {
+			job.cancel()
+		}
+	}
+}
+
+var errNoMinerAddr = errors.New("node has no miner address configured")
+
+// MiningStatus describes the background mining loop.
+type MiningStatus struct {
+	Running     bool      `json:"running"`
+	Started     time.Time `json:"started,omitempty"`
+	BlocksMined int64     `json:"blocks_mined"`
+	HashRate    float64   `json:"hash_rate"`
+}
+
+// miningLoop is the state of the background mining loop.
+type miningLoop struct {
+	mu          sync.Mutex
+	cancel      context.CancelFunc
+	done        chan struct{}
+	started     time.Time
+	blocksMined int64
+}
+
+// StartMining starts continuously mining blocks in the background. It does nothing if mining is already running.
+func (s *Server) StartMining() error {
+	if s.minerAddr == "" {
+		return errNoMinerAddr
+	}
+
+	s.miningLoop.mu.Lock()
+	defer s.miningLoop.mu.Unlock()
+
+	if s.miningLoop.cancel != nil {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.miningLoop.cancel = cancel
+	s.miningLoop.done = make(chan struct{})
+	s.miningLoop.started = time.Now()
+	s.miningLoop.blocksMined = 0
+
+	go func(done chan struct{}) {
+		defer close(done)
+		s.mineContinuously(ctx)
+	}(s.miningLoop.done)
+
+	log.Println("background mining started")
+	return nil
+}
+
+// StopMining stops the background mining loop and waits for it to exit.
+func (s *Server) StopMining() {
+	s.miningLoop.mu.Lock()
+	cancel, done := s.miningLoop.cancel, s.miningLoop.done
+	s.miningLoop.cancel = nil
+	s.miningLoop.mu.Unlock()
+
+	if cancel == nil {
+		return
+	}
+	cancel()
+	<-done
+	log.Println("background mining stopped")
+}
+
+// MiningStatus reports whether the background mining loop is running and how it is doing.
+func (s *Server) MiningStatus() *MiningStatus {
+	s.miningLoop.mu.Lock()
+	defer s.miningLoop.mu.Unlock()
+
+	status := &MiningStatus{Running: s.miningLoop.cancel != nil, BlocksMined: s.miningLoop.blocksMined}
+	if status.Running {
+		status.Started = s.miningLoop.started
+		status.HashRate = s.miner.HashRate()
+	}
+	return status
+}
+
+func (s *Server) handleMineStart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := s.StartMining(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.handleMineStatus(w, r)
+}
+
+func (s *Server) handleMineStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.StopMining()
+	s.handleMineStatus(w, r)
+}
+
+func (s *Server) handleMineStatus(w http.ResponseWriter, r *http.Request) {
+	if err := json.NewEncoder(w).Encode(s.MiningStatus()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// mineContinuously mines blocks until the context is cancelled. Each block is built from the current tip and pool
+// and is abandoned (and rebuilt) if the tip changes while it is being mined.
+func (s *Server) mineContinuously(ctx context.Context) {
+	for ctx.Err() == nil {
+		block, err := s.mineBlock(ctx)
+		if block != nil {
+			s.miningLoop.mu.Lock()
+			s.miningLoop.blocksMined++
+			s.miningLoop.mu.Unlock()
+		}
+		switch err {
+		case nil:
+		case blocks.ErrMiningAborted:
+			// tip changed or mining was stopped
+		default:
+			log.Printf("background mining failed: %s", err.Error())
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// mineBlock mines a block containing the pooled transactions on top of the current tip, appends it to the chain
+// and broadcasts it to the cluster. If the broadcast fails the appended block is returned along with the error.
+func (s *Server) mineBlock(ctx context.Context) (*blocks.Block, error) {
+	if s.minerAddr == "" {
+		return nil, errNoMinerAddr
+	}
+
+	//create a new block to be mined from the highest fee rate pooled transactions. The job is registered before the
+	//chain is unlocked so a tip change after this point always aborts it.
+	var newBlock *blocks.Block
+	var done func()
+	now := time.Now()
+	s.chain.ReadTip(func(last *blocks.Block, bits uint32, unspent *blocks.TxnOutUnspentSet) error {
+		pooled, fees := s.pool.BlockTxns(unspent, last.Index+1, now)
+		txns := append([]*blocks.Transaction{blocks.NewCoinbaseTransaction(s.minerAddr, last.Index+1, fees)}, pooled...)
+		newBlock = &blocks.Block{
+			BlockHeader: blocks.BlockHeader{
+				Version:    blocks.CurrentBlockVersion,
+				Index:      last.Index + 1,
+				PrevHash:   last.Hash,
+				MerkleRoot: blocks.TxnMerkleRoot(blocks.CurrentBlockVersion, txns),
+				Timestamp:  now,
+				Bits:       bits,
+			},
+			Data: txns,
+		}
+		ctx, done = s.miningJobs.start(ctx, last.Hash)
+		return nil
+	})
+	defer done()
+
+	//mine the block + keep the hash in line with the block content
+	if err := s.miner.Mine(ctx, newBlock); err != nil {
+		if err == blocks.ErrMiningAborted {
+			return nil, err
+		}
+		return nil, errors.Wrap(err, "failed finding nonce")
+	}
+
+	if err := s.chain.Append(newBlock); err != nil {
+		return nil, errors.Wrap(err, "block found but could not be appended to chain")
+	}
+
+	if err := s.cluster.Broadcast(&BlockEvent{EventNewBlock, newBlock.Hash, newBlock.Index, s.cluster.serf.LocalMember().Name}); err != nil {
+		return newBlock, errors.Wrap(err, "block was appended to chain but could not be broadcast")
+	}
+	return newBlock, nil
+}
@@ -7,11 +7,11 @@ import (
 
 	"github.com/hashicorp/serf/serf"
 	"github.com/pkg/errors"
-	"github.com/warmans/catbux/pkg/blocks"
 )
 
 const (
 	EventNewBlock = "block.new"
+	EventNewTxn   = "txn.new"
 )
 
 func NewCluster(config *serf.Config, seedNodes ...string) (*Cluster, error) {
@@ -38,12 +38,12 @@ type Cluster struct {
 	Events chan serf.Event
 }
 
-func (p *Cluster) Broadcast(ev *BlockEvent) error {
+func (p *Cluster) Broadcast(ev Event) error {
 	data := bytes.NewBuffer([]byte{})
 	if err := json.NewEncoder(data).Encode(ev); err != nil {
 		return err
 	}
-	return p.serf.UserEvent(ev.EventType, data.Bytes(), false)
+	return p.serf.UserEvent(ev.Name(), data.Bytes(), false)
 }
 
 func (p *Cluster) Close() error {
@@ -65,8 +65,32 @@ func (p *Cluster) GetPeer(nodeID string) *serf.Member {
 	return nil
 }
 
+// Event is any payload that can be broadcast to the cluster as a user event.
+type Event interface {
+	Name() string
+}
+
+// BlockEvent announces a new block. Serf user events are limited to serf.UserEventSizeLimit bytes so only the hash is
+// sent. Peers that do not have the block fetch it (and any missing ancestors) from the node over the transfer port.
 type BlockEvent struct {
-	EventType string        `json:"event"`
-	Block     *blocks.Block `json:"block"`
-	NodeID    string        `json:"node_id"`
+	EventType string `json:"event"`
+	Hash      string `json:"hash"`
+	Index     int64  `json:"index"`
+	NodeID    string `json:"node_id"`
+}
+
+func (e *BlockEvent) Name() string {
+	return e.EventType
+}
+
+// TxnEvent announces a new pooled transaction by ID. Peers that do not have it fetch it from the node over the
+// transfer port.
+type TxnEvent struct {
+	EventType string `json:"event"`
+	TxnID     string `json:"txn_id"`
+	NodeID    string `json:"node_id"`
+}
+
+func (e *TxnEvent) Name() string {
+	return e.EventType
 }
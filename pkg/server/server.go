@@ -2,31 +2,48 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
-	"time"
+	"strings"
 
 	"github.com/hashicorp/serf/serf"
 	"github.com/pkg/errors"
 	"github.com/warmans/catbux/pkg/blocks"
 )
 
-func New(APIAddr string, chain *blocks.Blockchain, cluster *Cluster, tm *TransferManager) *Server {
-	return &Server{addr: APIAddr, chain: chain, cluster: cluster, tm: tm}
+func New(APIAddr string, minerAddr string, miner *blocks.Miner, chain *blocks.Blockchain, pool *blocks.TxnPool, cluster *Cluster, tm *TransferManager) *Server {
+	return &Server{addr: APIAddr, minerAddr: minerAddr, miner: miner, chain: chain, pool: pool, cluster: cluster, tm: tm}
 }
 
 type Server struct {
-	addr    string
-	chain   *blocks.Blockchain
-	cluster *Cluster
-	tm      *TransferManager
+	addr       string
+	minerAddr  string
+	miner      *blocks.Miner
+	miningJobs miningJobs
+	miningLoop miningLoop
+	chain      *blocks.Blockchain
+	pool       *blocks.TxnPool
+	cluster    *Cluster
+	tm         *TransferManager
 }
 
 func (s *Server) Start() error {
 
 	http.Handle("/blocks", http.HandlerFunc(s.handleBlocks))
 	http.Handle("/mine", http.HandlerFunc(s.handleMine))
+	http.Handle("/mine/start", http.HandlerFunc(s.handleMineStart))
+	http.Handle("/mine/stop", http.HandlerFunc(s.handleMineStop))
+	http.Handle("/mine/status", http.HandlerFunc(s.handleMineStatus))
 	http.Handle("/peers", http.HandlerFunc(s.handlePeers))
+	http.Handle("/transactions", http.HandlerFunc(s.handleTransactions))
+	http.Handle("/transactions/", http.HandlerFunc(s.handleTransactionProof))
+	http.Handle("/unspent", http.HandlerFunc(s.handleUnspent))
+
+	chainEvents := s.chain.Subscribe()
+	go func() {
+		s.processChainEvents(chainEvents)
+	}()
 
 	//initial sync
 	if err := s.syncChain(); err != nil {
@@ -56,36 +73,104 @@ func (s *Server) handleBlocks(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleMine(w http.ResponseWriter, r *http.Request) {
+	if _, err := s.mineBlock(r.Context()); err != nil {
+		switch err {
+		case errNoMinerAddr:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case blocks.ErrMiningAborted:
+			http.Error(w, "mining aborted: chain tip changed or request was cancelled", http.StatusConflict)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	s.handleBlocks(w, r)
+}
 
-	//create a new block to be mined
-	newBlock := &blocks.Block{
-		Index:     int64(s.chain.Len()),
-		PrevHash:  s.chain.Last().Hash,
-		Timestamp: time.Now(),
-		//Data:       string(data),
-		Difficulty: s.chain.GetCurrentDifficulty(),
+func (s *Server) handlePeers(w http.ResponseWriter, r *http.Request) {
+	err := json.NewEncoder(w).Encode(s.cluster.Peers())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
+}
 
-	//mine the block + keep the hash in line with the block content
-	if err := blocks.FindNonce(newBlock); err != nil {
-		http.Error(w, errors.Wrap(err, "failed finding nonce").Error(), http.StatusInternalServerError)
-		return
+func (s *Server) handleTransactions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if err := json.NewEncoder(w).Encode(s.pool.Txns()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case http.MethodPost:
+		// transactions are limited to the same size as on the transfer port
+		r.Body = http.MaxBytesReader(w, r.Body, MaxMessageSize)
+		txn := &blocks.Transaction{}
+		if err := json.NewDecoder(r.Body).Decode(txn); err != nil {
+			http.Error(w, errors.Wrap(err, "failed to decode transaction").Error(), http.StatusBadRequest)
+			return
+		}
+		err := s.chain.ReadUnspent(func(unspent *blocks.TxnOutUnspentSet) error {
+			return s.pool.Add(txn, unspent)
+		})
+		if err != nil {
+			http.Error(w, errors.Wrap(err, "transaction was rejected").Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.cluster.Broadcast(&TxnEvent{EventNewTxn, txn.ID, s.cluster.serf.LocalMember().Name}); err != nil {
+			http.Error(w, errors.Wrap(err, "transaction was added to the pool but could not be broadcast").Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(txn); err != nil {
+			log.Printf("failed to encode transaction response: %s", err.Error())
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 	}
+}
 
-	if err := s.chain.Append(newBlock); err != nil {
-		http.Error(w, errors.Wrap(err, "node found but could not be appended to chain").Error(), http.StatusInternalServerError)
+// TxnProof is a Merkle proof that a transaction is on the main chain.
+type TxnProof struct {
+	*blocks.MerkleProof
+	Confirmations int64 `json:"confirmations"`
+}
+
+// handleTransactionProof serves /transactions/{id}/proof.
+func (s *Server) handleTransactionProof(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/transactions/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "proof" {
+		http.NotFound(w, r)
 		return
 	}
-
-	if err := s.cluster.Broadcast(&BlockEvent{EventNewBlock, newBlock, s.cluster.serf.LocalMember().Name}); err != nil {
-		log.Printf("failed to broadcast new block: %s", err.Error())
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	block, confirmations := s.chain.FindTransaction(parts[0])
+	if block == nil {
+		http.Error(w, fmt.Sprintf("txn %s is not on the main chain", parts[0]), http.StatusNotFound)
+		return
+	}
+	proof, err := blocks.NewMerkleProof(block, parts[0])
+	if err != nil {
+		http.Error(w, errors.Wrap(err, "failed to create proof").Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(&TxnProof{MerkleProof: proof, Confirmations: confirmations}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
-	s.handleBlocks(w, r)
 }
 
-func (s *Server) handlePeers(w http.ResponseWriter, r *http.Request) {
-	err := json.NewEncoder(w).Encode(s.cluster.Peers())
-	if err != nil {
+func (s *Server) handleUnspent(w http.ResponseWriter, r *http.Request) {
+	var unspent []*blocks.TxnOutUnspent
+	s.chain.ReadUnspent(func(set *blocks.TxnOutUnspentSet) error {
+		if address := r.URL.Query().Get("address"); address != "" {
+			unspent = set.ForAddress(address)
+		} else {
+			unspent = set.All()
+		}
+		return nil
+	})
+	if err := json.NewEncoder(w).Encode(unspent); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
@@ -98,7 +183,11 @@ func (s *Server) processEvents() {
 			if ue.Name == EventNewBlock {
 				if err := s.processNewBlockEv(ue); err != nil {
 					log.Printf("error handling new block event: %s", err.Error())
-					return
+				}
+			}
+			if ue.Name == EventNewTxn {
+				if err := s.processNewTxnEv(ue); err != nil {
+					log.Printf("error handling new transaction event: %s", err.Error())
 				}
 			}
 		case serf.EventQuery:
@@ -116,24 +205,76 @@ func (s *Server) processNewBlockEv(ue serf.UserEvent) error {
 	if blockEv.NodeID == s.cluster.serf.LocalMember().Name {
 		return nil
 	}
-	expectedNextBlockIdx := s.chain.Last().Index + 1
-	if blockEv.Block.Index == expectedNextBlockIdx {
-		if err := s.chain.Append(blockEv.Block); err != nil {
-			return errors.Wrap(err, "append failed")
-		}
+	if blockEv.Hash == "" {
+		return fmt.Errorf("event from %s did not contain a block hash", blockEv.NodeID)
 	}
-	if blockEv.Block.Index > expectedNextBlockIdx {
-		log.Println("require full sync from " + blockEv.NodeID)
-		if peer := s.cluster.GetPeer(blockEv.NodeID); peer != nil {
-			if err := s.syncChainFrom(peer); err != nil {
-				return errors.Wrap(err, "syncing chain failed")
-			}
-			log.Println("sync OK")
-		}
+	if s.chain.HasBlock(blockEv.Hash) {
+		return nil
+	}
+	peer := s.cluster.GetPeer(blockEv.NodeID)
+	if peer == nil {
+		return fmt.Errorf("block %d was announced by unknown peer %s", blockEv.Index, blockEv.NodeID)
+	}
+	if err := s.syncChainFrom(peer); err != nil {
+		return errors.Wrapf(err, "syncing block %d failed", blockEv.Index)
 	}
 	return nil
 }
 
+// processChainEvents keeps the pool in line with the main chain and abandons mining of blocks that can no longer
+// extend it. Transactions from blocks removed by a reorg are returned to the pool if they are still valid.
+func (s *Server) processChainEvents(events <-chan *blocks.ChainEvent) {
+	for ev := range events {
+		s.miningJobs.abortStale(s.chain.Last().Hash)
+
+		s.chain.ReadUnspent(func(unspent *blocks.TxnOutUnspentSet) error {
+			s.pool.Update(unspent)
+			for _, b := range ev.Disconnected {
+				for k, txn := range b.Data {
+					if k == 0 {
+						continue //coinbase
+					}
+					if err := s.pool.Add(txn, unspent); err != nil && err != blocks.ErrTxnExists {
+						log.Printf("dropped txn %s from disconnected block %d: %s", txn.ID, b.Index, err.Error())
+					}
+				}
+			}
+			return nil
+		})
+	}
+}
+
+func (s *Server) processNewTxnEv(ue serf.UserEvent) error {
+	txnEv := &TxnEvent{}
+	if err := json.Unmarshal(ue.Payload, txnEv); err != nil {
+		return errors.Wrap(err, "decode failed")
+	}
+	if txnEv.NodeID == s.cluster.serf.LocalMember().Name {
+		return nil
+	}
+	if txnEv.TxnID == "" {
+		return fmt.Errorf("event from %s did not contain a transaction ID", txnEv.NodeID)
+	}
+	if s.pool.Get(txnEv.TxnID) != nil {
+		return nil
+	}
+	peer := s.cluster.GetPeer(txnEv.NodeID)
+	if peer == nil {
+		return fmt.Errorf("txn %s was announced by unknown peer %s", txnEv.TxnID, txnEv.NodeID)
+	}
+	txn, err := s.tm.FetchTransaction(peer, txnEv.TxnID)
+	if err != nil {
+		return errors.Wrapf(err, "failed to fetch txn %s", txnEv.TxnID)
+	}
+	err = s.chain.ReadUnspent(func(unspent *blocks.TxnOutUnspentSet) error {
+		return s.pool.Add(txn, unspent)
+	})
+	if err == blocks.ErrTxnExists {
+		return nil
+	}
+	return err
+}
+
 func (s *Server) syncChain() error {
 	peers := s.cluster.Peers()
 	if len(peers) == 0 {
@@ -0,0 +1,317 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/warmans/catbux/pkg/blocks"
+	"github.com/warmans/catbux/pkg/wallet"
+)
+
+// testNode is a server with its own chain, pool, transfer port and single node cluster (unless seeds are given).
+type testNode struct {
+	*Server
+	wallet *wallet.Wallet
+}
+
+func newTestNode(t *testing.T, name string, configure func(conf *serf.Config), seeds ...string) *testNode {
+	w, err := wallet.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := blocks.NewBlockchain()
+	pool := blocks.NewTxnPool()
+
+	tm := NewTransferManager(chain, pool)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tm.serve(conn)
+			}()
+		}
+	}()
+
+	conf := serf.DefaultConfig()
+	conf.Init()
+	conf.NodeName = name
+	conf.Tags = map[string]string{"transfer.port": fmt.Sprintf("%d", ln.Addr().(*net.TCPAddr).Port)}
+	conf.LogOutput = ioutil.Discard
+	conf.MemberlistConfig.LogOutput = ioutil.Discard
+	conf.MemberlistConfig.BindAddr = "127.0.0.1"
+	conf.MemberlistConfig.BindPort = 0
+	if configure != nil {
+		configure(conf)
+	}
+	cluster, err := NewCluster(conf, seeds...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cluster.serf.Shutdown() })
+
+	return &testNode{Server: New("", w.Address(), blocks.NewMiner(1), chain, pool, cluster, tm), wallet: w}
+}
+
+// clusterAddr is the address other nodes can join the node's cluster on.
+func (n *testNode) clusterAddr() string {
+	local := n.cluster.serf.LocalMember()
+	return net.JoinHostPort(local.Addr.String(), fmt.Sprintf("%d", local.Port))
+}
+
+func (n *testNode) mine(t *testing.T) *blocks.Block {
+	block, err := n.mineBlock(context.Background())
+	if err != nil {
+		t.Fatalf("failed to mine block: %s", err)
+	}
+	return block
+}
+
+// createTxn pays amount from the node's wallet to a new address.
+func (n *testNode) createTxn(t *testing.T, amount int64) *blocks.Transaction {
+	to, err := wallet.Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var txn *blocks.Transaction
+	err = n.chain.ReadUnspent(func(unspent *blocks.TxnOutUnspentSet) error {
+		txn, err = n.wallet.CreateTransaction(to.Address(), amount, 1, 0, unspent, n.pool.Txns())
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to create txn: %s", err)
+	}
+	return txn
+}
+
+func (n *testNode) postTxn(body []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	n.handleTransactions(w, httptest.NewRequest(http.MethodPost, "/transactions", bytes.NewReader(body)))
+	return w
+}
+
+func waitFor(t *testing.T, description string, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", description)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForTxnEvent waits for the node to see a txn.new event for the given txn.
+func waitForTxnEvent(t *testing.T, n *testNode, id string) {
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case e := <-n.cluster.Events:
+			ue, ok := e.(serf.UserEvent)
+			if !ok || ue.Name != EventNewTxn {
+				continue
+			}
+			ev := &TxnEvent{}
+			if err := json.Unmarshal(ue.Payload, ev); err != nil {
+				t.Fatal(err)
+			}
+			if ev.TxnID == id {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("txn %s was not broadcast", id)
+		}
+	}
+}
+
+func TestHandleTransactions(t *testing.T) {
+	node := newTestNode(t, "node", nil)
+	node.mine(t)
+	txn := node.createTxn(t, 10)
+	encoded, err := json.Marshal(txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := node.postTxn(encoded); res.Code != http.StatusCreated {
+		t.Fatalf("expected %d got %d: %s", http.StatusCreated, res.Code, res.Body.String())
+	}
+	if node.pool.Get(txn.ID) == nil {
+		t.Fatal("expected txn to be pooled")
+	}
+	waitForTxnEvent(t, node, txn.ID)
+
+	res := httptest.NewRecorder()
+	node.handleTransactions(res, httptest.NewRequest(http.MethodGet, "/transactions", nil))
+	pooled := []*blocks.Transaction{}
+	if err := json.NewDecoder(res.Body).Decode(&pooled); err != nil {
+		t.Fatal(err)
+	}
+	if len(pooled) != 1 || pooled[0].ID != txn.ID {
+		t.Fatalf("expected pooled txn to be listed got %v", pooled)
+	}
+
+	res = httptest.NewRecorder()
+	node.handleTransactions(res, httptest.NewRequest(http.MethodDelete, "/transactions", nil))
+	if res.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected %d got %d", http.StatusMethodNotAllowed, res.Code)
+	}
+}
+
+func TestHandleTransactionsRejectsInvalidTxns(t *testing.T) {
+	node := newTestNode(t, "node", nil)
+	node.mine(t)
+	node.mine(t)
+
+	pooled := node.createTxn(t, 10)
+	if res := node.postTxn(mustMarshal(t, pooled)); res.Code != http.StatusCreated {
+		t.Fatalf("failed to pool txn: %s", res.Body.String())
+	}
+
+	unsigned := node.createTxn(t, 10)
+	in, _ := unsigned.GetTxnIn(0)
+	in.Signature = ""
+
+	// a txn decoded from JSON keeps repeated txn ins
+	duplicateIns := &blocks.Transaction{Version: blocks.CurrentTxnVersion, TxnOut: unsigned.TxnOut}
+	encodedIn := string(mustMarshal(t, in))
+	if err := duplicateIns.TxnIn.UnmarshalJSON([]byte("[" + encodedIn + "," + encodedIn + "]")); err != nil {
+		t.Fatal(err)
+	}
+	duplicateIns.ID = blocks.GetTransactionID(duplicateIns)
+
+	tests := []struct {
+		name string
+		body []byte
+		err  string
+	}{
+		{name: "malformed JSON", body: []byte(`{"id":`), err: "failed to decode transaction"},
+		{name: "oversized body", body: append(bytes.Repeat([]byte(" "), MaxMessageSize), '{', '}'), err: "request body too large"},
+		{name: "already pooled", body: mustMarshal(t, pooled), err: blocks.ErrTxnExists.Error()},
+		{name: "unsigned", body: mustMarshal(t, unsigned), err: "failed to verify signature"},
+		{name: "repeated txn ins", body: mustMarshal(t, duplicateIns), err: "same txn out"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := node.postTxn(test.body)
+			if res.Code != http.StatusBadRequest {
+				t.Fatalf("expected %d got %d: %s", http.StatusBadRequest, res.Code, res.Body.String())
+			}
+			if !strings.Contains(res.Body.String(), test.err) {
+				t.Fatalf("expected error containing %q got %s", test.err, res.Body.String())
+			}
+		})
+	}
+	if len(node.pool.Txns()) != 1 {
+		t.Fatalf("expected only the valid txn to be pooled got %d txns", len(node.pool.Txns()))
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func TestBroadcastFailures(t *testing.T) {
+	// events are too big to broadcast
+	node := newTestNode(t, "node", func(conf *serf.Config) { conf.UserEventSizeLimit = 1 })
+
+	block, err := node.mineBlock(context.Background())
+	if block == nil || err == nil || !strings.Contains(err.Error(), "could not be broadcast") {
+		t.Fatalf("expected mined block to be returned with the broadcast error got %v %v", block, err)
+	}
+	if node.chain.Last().Hash != block.Hash {
+		t.Fatal("expected block to be appended")
+	}
+
+	txn := node.createTxn(t, 10)
+	if res := node.postTxn(mustMarshal(t, txn)); res.Code != http.StatusInternalServerError || !strings.Contains(res.Body.String(), "could not be broadcast") {
+		t.Fatalf("expected broadcast failure got %d: %s", res.Code, res.Body.String())
+	}
+	if node.pool.Get(txn.ID) == nil {
+		t.Fatal("expected txn to be pooled even though it was not broadcast")
+	}
+}
+
+func TestProcessChainEvents(t *testing.T) {
+	node := newTestNode(t, "node", nil)
+	go node.processChainEvents(node.chain.Subscribe())
+
+	shared := node.mine(t)
+	txn := node.createTxn(t, 10)
+	if res := node.postTxn(mustMarshal(t, txn)); res.Code != http.StatusCreated {
+		t.Fatalf("failed to pool txn: %s", res.Body.String())
+	}
+	mined := node.mine(t)
+	if len(mined.Data) != 2 || mined.Data[1].ID != txn.ID {
+		t.Fatal("expected pooled txn to be mined")
+	}
+	waitFor(t, "mined txn to leave the pool", func() bool { return node.pool.Get(txn.ID) == nil })
+
+	// a longer branch from the shared block that does not contain the txn
+	other := newTestNode(t, "other", nil)
+	if err := other.chain.Append(shared); err != nil {
+		t.Fatal(err)
+	}
+	branch := []*blocks.Block{other.mine(t), other.mine(t)}
+	for _, b := range branch {
+		if err := node.chain.Append(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if node.chain.Last().Hash != branch[1].Hash {
+		t.Fatal("expected the chain to switch to the longer branch")
+	}
+	waitFor(t, "disconnected txn to return to the pool", func() bool { return node.pool.Get(txn.ID) != nil })
+	if len(node.pool.Txns()) != 1 {
+		t.Fatal("expected only the disconnected txn to be pooled")
+	}
+}
+
+func TestGossip(t *testing.T) {
+	first := newTestNode(t, "first", nil)
+	first.mine(t)
+	second := newTestNode(t, "second", nil, first.clusterAddr())
+	waitFor(t, "nodes to join", func() bool { return first.cluster.GetPeer("second") != nil })
+
+	// a new node syncs the chain over the transfer port
+	if err := second.syncChain(); err != nil {
+		t.Fatalf("failed to sync: %s", err)
+	}
+	if second.chain.Last().Hash != first.chain.Last().Hash {
+		t.Fatal("expected chains to match after sync")
+	}
+
+	go first.processEvents()
+	go second.processEvents()
+
+	// pooled transactions are announced and fetched from the node that announced them
+	txn := first.createTxn(t, 10)
+	if res := first.postTxn(mustMarshal(t, txn)); res.Code != http.StatusCreated {
+		t.Fatalf("failed to pool txn: %s", res.Body.String())
+	}
+	waitFor(t, "txn to be fetched", func() bool { return second.pool.Get(txn.ID) != nil })
+
+	// mined blocks are announced and synced from the node that announced them
+	block := first.mine(t)
+	waitFor(t, "block to be synced", func() bool { return second.chain.Last().Hash == block.Hash })
+}
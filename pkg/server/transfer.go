@@ -1,19 +1,36 @@
 package server
 
 import (
-	"encoding/json"
+	"bufio"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"time"
 
 	"github.com/hashicorp/serf/serf"
 	"github.com/pkg/errors"
 	"github.com/warmans/catbux/pkg/blocks"
 )
 
-func NewTransferManager(chain *blocks.Blockchain) *TransferManager {
+const (
+	// MaxSyncBlocks is the most blocks that will be sent in response to a single sync request.
+	MaxSyncBlocks = 500
+
+	transferTimeout = time.Minute
+)
+
+// SyncRequest asks a peer for the blocks following the most recent block in the locator that it knows about. The
+// peer replies with the index of the common ancestor (-1 if there is none) and streams up to MaxSyncBlocks blocks
+// following it.
+type SyncRequest struct {
+	Locator []blocks.BlockRef `json:"locator"`
+}
+
+func NewTransferManager(chain *blocks.Blockchain, pool *blocks.TxnPool) *TransferManager {
 	return &TransferManager{
 		chain:       chain,
+		pool:        pool,
 		exit:        make(chan bool, 1),
 		errors:      make(chan error, 1000),
 		connections: make(chan net.Conn, 100),
@@ -22,30 +39,146 @@ func NewTransferManager(chain *blocks.Blockchain) *TransferManager {
 
 type TransferManager struct {
 	chain       *blocks.Blockchain
+	pool        *blocks.TxnPool
 	errors      chan error
 	connections chan net.Conn
 	exit        chan bool
 }
 
+// FetchChain requests blocks the local chain is missing from the given node. Blocks are added to the local chain as
+// they are received so if the node's chain has forked from the local chain the local chain switches to it once it has
+// more cumulative work.
 func (t *TransferManager) FetchChain(fromNode *serf.Member) error {
+	conn, rw, _, err := dialTransfer(fromNode)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
 
-	port, ok := fromNode.Tags["transfer.port"]
-	if !ok {
-		return fmt.Errorf("target host does not advertise a tranmsfer port")
+	tipIndex := t.chain.Last().Index
+	locator := t.chain.Locator()
+	for first := true; ; first = false {
+		conn.SetDeadline(time.Now().Add(transferTimeout))
+		req, err := (&SyncRequest{Locator: locator}).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if err := writeMessage(rw, MsgSyncRequest, req); err != nil {
+			return errors.Wrap(err, "failed to send sync request")
+		}
+		if err := rw.Flush(); err != nil {
+			return errors.Wrap(err, "failed to send sync request")
+		}
+
+		payload, err := expectMessage(rw, MsgSyncStart)
+		if err != nil {
+			return errors.Wrap(err, "failed to read sync response")
+		}
+		forkIndex, err := decodeInt64(payload)
+		if err != nil {
+			return errors.Wrap(err, "failed to decode sync start")
+		}
+		if forkIndex < 0 {
+			return fmt.Errorf("peer returned invalid fork index %d", forkIndex)
+		}
+		if first && forkIndex < tipIndex {
+			log.Printf("peer %s has forked from local chain at block %d", fromNode.Name, forkIndex)
+		}
+
+		last, received, err := t.receiveBlocks(conn, rw)
+		if err != nil {
+			return err
+		}
+		if received < MaxSyncBlocks {
+			return nil
+		}
+		// continue from the last received block which may not be on the local main chain (yet)
+		locator = append([]blocks.BlockRef{{Index: last.Index, Hash: last.Hash}}, t.chain.Locator()...)
 	}
+}
 
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%s", fromNode.Addr.String(), port))
+// FetchTransaction requests the pooled transaction with the given ID from the node.
+func (t *TransferManager) FetchTransaction(fromNode *serf.Member, id string) (*blocks.Transaction, error) {
+	conn, rw, version, err := dialTransfer(fromNode)
 	if err != nil {
-		return errors.Wrap(err, "failed to open connection to target host")
+		return nil, err
 	}
 	defer conn.Close()
 
-	chain := &blocks.Blockchain{}
-	if err := json.NewDecoder(conn).Decode(chain); err != nil {
-		return err
+	if version < 2 {
+		return nil, fmt.Errorf("peer %s does not support transaction requests", fromNode.Name)
+	}
+	if err := writeMessage(rw, MsgTxnRequest, []byte(id)); err != nil {
+		return nil, errors.Wrap(err, "failed to send txn request")
+	}
+	if err := rw.Flush(); err != nil {
+		return nil, errors.Wrap(err, "failed to send txn request")
+	}
+	payload, err := expectMessage(rw, MsgTxn)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read txn response")
+	}
+	txn := &blocks.Transaction{}
+	if err := txn.UnmarshalBinary(payload); err != nil {
+		return nil, err
+	}
+	if txn.ID != id {
+		return nil, fmt.Errorf("peer sent txn %s but %s was requested", txn.ID, id)
+	}
+	return txn, nil
+}
+
+// dialTransfer connects to the node's transfer port and returns the connection along with the protocol version
+// agreed in the handshake.
+func dialTransfer(node *serf.Member) (net.Conn, *bufio.ReadWriter, uint32, error) {
+	port, ok := node.Tags["transfer.port"]
+	if !ok {
+		return nil, nil, 0, fmt.Errorf("target host does not advertise a tranmsfer port")
 	}
 
-	return t.chain.Replace(chain)
+	conn, err := net.Dial("tcp", net.JoinHostPort(node.Addr.String(), port))
+	if err != nil {
+		return nil, nil, 0, errors.Wrap(err, "failed to open connection to target host")
+	}
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	conn.SetDeadline(time.Now().Add(transferTimeout))
+	version, err := clientHandshake(rw)
+	if err != nil {
+		conn.Close()
+		return nil, nil, 0, errors.Wrap(err, "handshake failed")
+	}
+	return conn, rw, version, nil
+}
+
+// receiveBlocks adds each block sent by the peer to the chain until the end of the sync response. It returns the
+// last block received and the number of blocks.
+func (t *TransferManager) receiveBlocks(conn net.Conn, r io.Reader) (*blocks.Block, int, error) {
+	var last *blocks.Block
+	for received := 0; ; received++ {
+		conn.SetDeadline(time.Now().Add(transferTimeout))
+		msgType, payload, err := readMessage(r)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "failed to read sync response")
+		}
+		switch msgType {
+		case MsgSyncEnd:
+			return last, received, nil
+		case MsgBlock:
+			if received >= MaxSyncBlocks {
+				return nil, 0, fmt.Errorf("peer sent more than %d blocks", MaxSyncBlocks)
+			}
+			if last, err = decodeBlock(payload); err != nil {
+				return nil, 0, errors.Wrap(err, "failed to decode synced block")
+			}
+			if err := t.chain.Append(last); err != nil && err != blocks.ErrBlockExists {
+				return nil, 0, errors.Wrapf(err, "failed to append synced block %d", last.Index)
+			}
+		default:
+			return nil, 0, fmt.Errorf("unexpected %s message in sync response", msgType)
+		}
+	}
 }
 
 func (t *TransferManager) Listen(transferAddr string) error {
@@ -67,10 +200,9 @@ func (t *TransferManager) Listen(transferAddr string) error {
 			case conn := <-t.connections:
 				go func() {
 					defer conn.Close()
-					if err := json.NewEncoder(conn).Encode(t.chain.Snapshot()); err != nil {
+					if err := t.serve(conn); err != nil {
 						t.errors <- err
 					}
-					return
 				}()
 			case err := <-t.errors:
 				log.Printf("error in transfer listener: %s", err.Error())
@@ -88,6 +220,135 @@ func (t *TransferManager) Listen(transferAddr string) error {
 	}
 }
 
+// serve answers requests on the connection until the client closes it.
+func (t *TransferManager) serve(conn net.Conn) error {
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	conn.SetDeadline(time.Now().Add(transferTimeout))
+	version, err := serverHandshake(rw)
+	if err != nil {
+		return errors.Wrapf(err, "handshake with %s failed", conn.RemoteAddr())
+	}
+
+	for {
+		conn.SetDeadline(time.Now().Add(transferTimeout))
+		msgType, payload, err := readMessage(rw)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return errors.Wrap(err, "failed to read request")
+		}
+		switch {
+		case msgType == MsgSyncRequest:
+			err = t.serveSync(conn, rw, payload)
+		case msgType == MsgTxnRequest && version >= 2:
+			err = t.serveTxn(rw, string(payload))
+		default:
+			err = fmt.Errorf("unexpected %s message", msgType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// serveTxn sends the requested transaction from the pool.
+func (t *TransferManager) serveTxn(rw *bufio.ReadWriter, id string) error {
+	txn := t.pool.Get(id)
+	if txn == nil {
+		writeMessage(rw, MsgError, []byte(fmt.Sprintf("txn %s is not in the pool", id)))
+		return rw.Flush()
+	}
+	encoded, err := txn.MarshalBinary()
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode txn %s", id)
+	}
+	if err := writeMessage(rw, MsgTxn, encoded); err != nil {
+		return errors.Wrap(err, "failed to send txn")
+	}
+	return rw.Flush()
+}
+
+// serveSync answers a sync request by streaming the blocks the client is missing.
+func (t *TransferManager) serveSync(conn net.Conn, rw *bufio.ReadWriter, payload []byte) error {
+	req := &SyncRequest{}
+	if err := req.UnmarshalBinary(payload); err != nil {
+		return errors.Wrap(err, "failed to decode sync request")
+	}
+
+	forkIndex, missing := t.chain.BlocksAfter(req.Locator, MaxSyncBlocks)
+	if err := writeMessage(rw, MsgSyncStart, encodeInt64(forkIndex)); err != nil {
+		return errors.Wrap(err, "failed to send sync response")
+	}
+	for _, b := range missing {
+		encoded, err := encodeBlock(b)
+		if err != nil {
+			return errors.Wrapf(err, "failed to encode block %d", b.Index)
+		}
+		conn.SetDeadline(time.Now().Add(transferTimeout))
+		if err := writeMessage(rw, MsgBlock, encoded); err != nil {
+			return errors.Wrap(err, "failed to send sync response")
+		}
+	}
+	if err := writeMessage(rw, MsgSyncEnd, nil); err != nil {
+		return errors.Wrap(err, "failed to send sync response")
+	}
+	if err := rw.Flush(); err != nil {
+		return errors.Wrap(err, "failed to send sync response")
+	}
+	return nil
+}
+
+// clientHandshake sends the local protocol version and checks the version chosen by the server is supported. The
+// chosen version is returned.
+func clientHandshake(rw *bufio.ReadWriter) (uint32, error) {
+	if err := writeMessage(rw, MsgHello, encodeUint32(ProtocolVersion)); err != nil {
+		return 0, err
+	}
+	if err := rw.Flush(); err != nil {
+		return 0, err
+	}
+	payload, err := expectMessage(rw, MsgHello)
+	if err != nil {
+		return 0, err
+	}
+	version, err := decodeUint32(payload)
+	if err != nil {
+		return 0, err
+	}
+	if version < MinProtocolVersion || version > ProtocolVersion {
+		return 0, fmt.Errorf("server chose unsupported protocol version %d", version)
+	}
+	return version, nil
+}
+
+// serverHandshake reads the client's protocol version and replies with (and returns) the highest version both sides
+// support.
+func serverHandshake(rw *bufio.ReadWriter) (uint32, error) {
+	payload, err := expectMessage(rw, MsgHello)
+	if err != nil {
+		return 0, err
+	}
+	version, err := decodeUint32(payload)
+	if err != nil {
+		return 0, err
+	}
+	if version < MinProtocolVersion {
+		msg := fmt.Sprintf("protocol version %d is not supported (minimum %d)", version, MinProtocolVersion)
+		writeMessage(rw, MsgError, []byte(msg))
+		rw.Flush()
+		return 0, errors.New(msg)
+	}
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	if err := writeMessage(rw, MsgHello, encodeUint32(version)); err != nil {
+		return 0, err
+	}
+	return version, rw.Flush()
+}
+
 func (t *TransferManager) Close() {
 	t.exit <- true
 }
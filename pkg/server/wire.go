@@ -0,0 +1,230 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/warmans/catbux/pkg/blocks"
+)
+
+const (
+	// ProtocolVersion is the version of the transfer protocol spoken by this node. Version 2 added transaction
+	// requests.
+	ProtocolVersion uint32 = 2
+	// MinProtocolVersion is the oldest version of the transfer protocol this node will talk to.
+	MinProtocolVersion uint32 = 1
+
+	// MaxMessageSize is the largest message payload that will be accepted from a peer.
+	MaxMessageSize = 8 << 20
+
+	// messageHeaderSize is the size of the type and payload length that precede each message.
+	messageHeaderSize = 1 + 4
+)
+
+// MessageType identifies the payload of a message on the transfer port.
+type MessageType uint8
+
+const (
+	// MsgHello carries the sender's protocol version. The client sends it first and the server replies with the
+	// version both sides will use.
+	MsgHello MessageType = iota + 1
+	// MsgError carries a reason for closing the connection.
+	MsgError
+	// MsgSyncRequest carries a SyncRequest.
+	MsgSyncRequest
+	// MsgSyncStart carries the fork index found from a SyncRequest and is followed by MsgBlock messages.
+	MsgSyncStart
+	// MsgBlock carries a single block.
+	MsgBlock
+	// MsgSyncEnd ends the blocks sent in response to a SyncRequest.
+	MsgSyncEnd
+	// MsgTxnRequest carries the ID of a pooled transaction the client wants.
+	MsgTxnRequest
+	// MsgTxn carries the canonical encoding of the transaction asked for by a MsgTxnRequest.
+	MsgTxn
+)
+
+func (t MessageType) String() string {
+	switch t {
+	case MsgHello:
+		return "hello"
+	case MsgError:
+		return "error"
+	case MsgSyncRequest:
+		return "sync request"
+	case MsgSyncStart:
+		return "sync start"
+	case MsgBlock:
+		return "block"
+	case MsgSyncEnd:
+		return "sync end"
+	case MsgTxnRequest:
+		return "txn request"
+	case MsgTxn:
+		return "txn"
+	default:
+		return fmt.Sprintf("unknown (%d)", uint8(t))
+	}
+}
+
+// writeMessage writes a message as its type, the length of the payload as a uint32 and the payload.
+func writeMessage(w io.Writer, msgType MessageType, payload []byte) error {
+	if len(payload) > MaxMessageSize {
+		return fmt.Errorf("%s message of %d bytes exceeded the maximum message size", msgType, len(payload))
+	}
+	msg := make([]byte, messageHeaderSize, messageHeaderSize+len(payload))
+	msg[0] = byte(msgType)
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(payload)))
+	_, err := w.Write(append(msg, payload...))
+	return err
+}
+
+// readMessage reads the next message. Payloads larger than MaxMessageSize are rejected before they are read.
+func readMessage(r io.Reader) (MessageType, []byte, error) {
+	header := make([]byte, messageHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	msgType := MessageType(header[0])
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > MaxMessageSize {
+		return 0, nil, fmt.Errorf("%s message of %d bytes exceeded the maximum message size", msgType, size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, errors.Wrapf(err, "failed to read %s message", msgType)
+	}
+	if msgType == MsgError {
+		return msgType, payload, fmt.Errorf("peer sent error: %s", string(payload))
+	}
+	return msgType, payload, nil
+}
+
+// expectMessage reads the next message and fails if it is not of the given type.
+func expectMessage(r io.Reader, msgType MessageType) ([]byte, error) {
+	gotType, payload, err := readMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	if gotType != msgType {
+		return nil, fmt.Errorf("expected %s message but got %s", msgType, gotType)
+	}
+	return payload, nil
+}
+
+func encodeUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func decodeUint32(payload []byte) (uint32, error) {
+	if len(payload) != 4 {
+		return 0, fmt.Errorf("expected 4 byte payload but got %d bytes", len(payload))
+	}
+	return binary.BigEndian.Uint32(payload), nil
+}
+
+func encodeInt64(v int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+func decodeInt64(payload []byte) (int64, error) {
+	if len(payload) != 8 {
+		return 0, fmt.Errorf("expected 8 byte payload but got %d bytes", len(payload))
+	}
+	return int64(binary.BigEndian.Uint64(payload)), nil
+}
+
+// MarshalBinary encodes the request as the number of locator entries followed by each entry's index and hash.
+func (r *SyncRequest) MarshalBinary() ([]byte, error) {
+	buff := &bytes.Buffer{}
+	buff.Write(encodeUint32(uint32(len(r.Locator))))
+	for _, ref := range r.Locator {
+		buff.Write(encodeInt64(ref.Index))
+		buff.Write(encodeUint32(uint32(len(ref.Hash))))
+		buff.WriteString(ref.Hash)
+	}
+	return buff.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a request encoded by MarshalBinary.
+func (r *SyncRequest) UnmarshalBinary(payload []byte) error {
+	buff := bytes.NewReader(payload)
+	var count uint32
+	if err := binary.Read(buff, binary.BigEndian, &count); err != nil {
+		return errors.Wrap(err, "failed to read locator length")
+	}
+	// each entry is at least an index and a hash length
+	if int64(count) > int64(buff.Len())/12 {
+		return fmt.Errorf("locator of %d entries was longer than the payload", count)
+	}
+	locator := make([]blocks.BlockRef, count)
+	for k := range locator {
+		var size uint32
+		if err := binary.Read(buff, binary.BigEndian, &locator[k].Index); err != nil {
+			return errors.Wrap(err, "failed to read locator index")
+		}
+		if err := binary.Read(buff, binary.BigEndian, &size); err != nil {
+			return errors.Wrap(err, "failed to read locator hash length")
+		}
+		if int64(size) > int64(buff.Len()) {
+			return fmt.Errorf("locator hash of %d bytes was longer than the payload", size)
+		}
+		hash := make([]byte, size)
+		if _, err := io.ReadFull(buff, hash); err != nil {
+			return errors.Wrap(err, "failed to read locator hash")
+		}
+		locator[k].Hash = string(hash)
+	}
+	if buff.Len() != 0 {
+		return fmt.Errorf("%d bytes of unexpected trailing data", buff.Len())
+	}
+	r.Locator = locator
+	return nil
+}
+
+// encodeBlock encodes the block's hash and timestamp zone offset followed by its canonical encoding. The hash and
+// zone are not part of the canonical encoding but older block versions cannot be re-hashed without the zone.
+func encodeBlock(b *blocks.Block) ([]byte, error) {
+	encoded, err := b.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	_, offset := b.Timestamp.Zone()
+
+	buff := &bytes.Buffer{}
+	buff.Write(encodeUint32(uint32(len(b.Hash))))
+	buff.WriteString(b.Hash)
+	buff.Write(encodeUint32(uint32(int32(offset))))
+	buff.Write(encoded)
+	return buff.Bytes(), nil
+}
+
+func decodeBlock(payload []byte) (*blocks.Block, error) {
+	if len(payload) < 4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	hashSize := int64(binary.BigEndian.Uint32(payload))
+	if hashSize > int64(len(payload)-8) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	hash := string(payload[4 : 4+hashSize])
+	offset := int32(binary.BigEndian.Uint32(payload[4+hashSize:]))
+
+	block := &blocks.Block{}
+	if err := block.UnmarshalBinary(payload[8+hashSize:]); err != nil {
+		return nil, err
+	}
+	block.Hash = hash
+	if offset != 0 {
+		block.Timestamp = block.Timestamp.In(time.FixedZone("", int(offset)))
+	}
+	return block, nil
+}
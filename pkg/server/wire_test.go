@@ -0,0 +1,293 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/warmans/catbux/pkg/blocks"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	buff := &bytes.Buffer{}
+	for _, msg := range []struct {
+		msgType MessageType
+		payload []byte
+	}{{MsgHello, encodeUint32(ProtocolVersion)}, {MsgSyncEnd, nil}, {MsgTxnRequest, []byte("txn-id")}} {
+		if err := writeMessage(buff, msg.msgType, msg.payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	payload, err := expectMessage(buff, MsgHello)
+	if err != nil || !bytes.Equal(payload, encodeUint32(ProtocolVersion)) {
+		t.Fatalf("unexpected hello: %v %v", payload, err)
+	}
+	if payload, err = expectMessage(buff, MsgSyncEnd); err != nil || len(payload) != 0 {
+		t.Fatalf("unexpected sync end: %v %v", payload, err)
+	}
+	if _, err = expectMessage(buff, MsgSyncEnd); err == nil || !strings.Contains(err.Error(), "expected sync end message but got txn request") {
+		t.Fatalf("expected wrong message type to be rejected got %v", err)
+	}
+	if _, _, err := readMessage(buff); err != io.EOF {
+		t.Fatalf("expected EOF got %v", err)
+	}
+}
+
+func TestMessageSizeLimit(t *testing.T) {
+	if err := writeMessage(&bytes.Buffer{}, MsgBlock, make([]byte, MaxMessageSize+1)); err == nil {
+		t.Fatal("expected oversized message to be rejected on write")
+	}
+
+	// only the header of the oversized message is sent so it must be rejected before the payload is read
+	header := []byte{byte(MsgBlock), 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(header[1:], MaxMessageSize+1)
+	if _, _, err := readMessage(bytes.NewReader(header)); err == nil || !strings.Contains(err.Error(), "exceeded the maximum message size") {
+		t.Fatalf("expected oversized message to be rejected on read got %v", err)
+	}
+
+	if err := writeMessage(&bytes.Buffer{}, MsgBlock, make([]byte, MaxMessageSize)); err != nil {
+		t.Fatalf("expected message of the maximum size to be written: %s", err)
+	}
+}
+
+func TestReadMalformedMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{name: "partial header", data: []byte{byte(MsgBlock), 0, 0}, err: "unexpected EOF"},
+		{name: "partial payload", data: []byte{byte(MsgBlock), 0, 0, 0, 4, 1, 2}, err: "failed to read block message"},
+		{name: "peer error", data: []byte{byte(MsgError), 0, 0, 0, 3, 'b', 'a', 'd'}, err: "peer sent error: bad"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := readMessage(bytes.NewReader(test.data)); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestSyncRequestRoundTrip(t *testing.T) {
+	for _, req := range []*SyncRequest{
+		{Locator: []blocks.BlockRef{}},
+		{Locator: []blocks.BlockRef{{Index: 12, Hash: "00ab"}, {Index: 10, Hash: "00cd"}, {Index: 0, Hash: "genesis"}}},
+		{Locator: []blocks.BlockRef{{Index: 1, Hash: ""}}},
+	} {
+		encoded, err := req.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded := &SyncRequest{}
+		if err := decoded.UnmarshalBinary(encoded); err != nil {
+			t.Fatalf("failed to decode: %s", err)
+		}
+		if !reflect.DeepEqual(decoded, req) {
+			t.Fatalf("expected %+v got %+v", req, decoded)
+		}
+	}
+}
+
+func TestSyncRequestRejectsMalformedPayloads(t *testing.T) {
+	valid, err := (&SyncRequest{Locator: []blocks.BlockRef{{Index: 12, Hash: "00ab"}}}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	withHashSize := func(size uint32) []byte {
+		c := append([]byte{}, valid...)
+		binary.BigEndian.PutUint32(c[12:], size)
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		payload []byte
+		err     string
+	}{
+		{name: "empty", payload: []byte{}, err: "failed to read locator length"},
+		{name: "count longer than payload", payload: append(encodeUint32(1<<30), valid[4:]...), err: "was longer than the payload"},
+		{name: "truncated index", payload: append(encodeUint32(1), 0, 0, 0), err: "was longer than the payload"},
+		{name: "hash longer than payload", payload: withHashSize(1 << 31), err: "locator hash of 2147483648 bytes"},
+		{name: "truncated hash", payload: valid[:len(valid)-1], err: "locator hash of 4 bytes"},
+		{name: "trailing data", payload: append(append([]byte{}, valid...), 1), err: "unexpected trailing data"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := (&SyncRequest{}).UnmarshalBinary(test.payload); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestBlockRoundTrip(t *testing.T) {
+	txns := []*blocks.Transaction{blocks.NewCoinbaseTransaction("miner", 1, 0)}
+	current := &blocks.Block{
+		BlockHeader: blocks.BlockHeader{
+			Version:    blocks.CurrentBlockVersion,
+			Index:      1,
+			PrevHash:   blocks.Genesis.Hash,
+			MerkleRoot: blocks.TxnMerkleRoot(blocks.CurrentBlockVersion, txns),
+			Timestamp:  time.Now().UTC(),
+			Bits:       0x1f00ffff,
+		},
+		Data: txns,
+	}
+	// legacy block hashes include the timestamp's zone so it must survive the round trip
+	legacy := &blocks.Block{
+		BlockHeader: blocks.BlockHeader{
+			Version:    blocks.BlockVersionLegacy,
+			Index:      1,
+			PrevHash:   blocks.Genesis.Hash,
+			Timestamp:  time.Date(2018, 1, 2, 3, 4, 5, 6, time.FixedZone("", 3600)),
+			Difficulty: 1,
+		},
+		Data: txns,
+	}
+
+	for _, block := range []*blocks.Block{current, legacy} {
+		hash, err := blocks.Hash(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.Hash = hash
+
+		encoded, err := encodeBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := decodeBlock(encoded)
+		if err != nil {
+			t.Fatalf("failed to decode version %d block: %s", block.Version, err)
+		}
+		if decoded.Hash != block.Hash {
+			t.Fatalf("expected hash %s got %s", block.Hash, decoded.Hash)
+		}
+		if rehashed, err := blocks.Hash(decoded); err != nil || rehashed != block.Hash {
+			t.Fatalf("expected decoded version %d block to hash to %s got %s (%v)", block.Version, block.Hash, rehashed, err)
+		}
+		if len(decoded.Data) != 1 || decoded.Data[0].ID != txns[0].ID {
+			t.Fatal("transactions did not survive the round trip")
+		}
+	}
+}
+
+func TestDecodeBlockRejectsMalformedPayloads(t *testing.T) {
+	block := &blocks.Block{BlockHeader: blocks.BlockHeader{Version: blocks.BlockVersionLegacy, Index: 1}, Hash: "hash", Data: []*blocks.Transaction{}}
+	valid, err := encodeBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeBlock(valid); err != nil {
+		t.Fatalf("expected valid payload to decode: %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{name: "empty", payload: []byte{}},
+		{name: "hash longer than payload", payload: append(encodeUint32(1<<31), valid[4:]...)},
+		{name: "missing zone", payload: valid[:8]},
+		{name: "truncated block", payload: valid[:len(valid)-1]},
+		{name: "trailing data", payload: append(append([]byte{}, valid...), 1)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := decodeBlock(test.payload); err == nil {
+				t.Fatal("expected malformed payload to be rejected")
+			}
+		})
+	}
+}
+
+func TestServerHandshake(t *testing.T) {
+	tests := []struct {
+		name          string
+		clientVersion uint32
+		agreed        uint32
+		err           string
+	}{
+		{name: "same version", clientVersion: ProtocolVersion, agreed: ProtocolVersion},
+		{name: "older client", clientVersion: MinProtocolVersion, agreed: MinProtocolVersion},
+		{name: "newer client", clientVersion: ProtocolVersion + 1, agreed: ProtocolVersion},
+		{name: "unsupported client", clientVersion: MinProtocolVersion - 1, err: "is not supported"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hello := &bytes.Buffer{}
+			writeMessage(hello, MsgHello, encodeUint32(test.clientVersion))
+			reply := &bytes.Buffer{}
+			agreed, err := serverHandshake(bufio.NewReadWriter(bufio.NewReader(hello), bufio.NewWriter(reply)))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q got %v", test.err, err)
+				}
+				// the client is told why
+				if _, _, err := readMessage(reply); err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected client to receive error containing %q got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if agreed != test.agreed {
+				t.Fatalf("expected version %d got %d", test.agreed, agreed)
+			}
+			payload, err := expectMessage(reply, MsgHello)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version, _ := decodeUint32(payload); version != test.agreed {
+				t.Fatalf("expected client to be sent version %d got %d", test.agreed, version)
+			}
+		})
+	}
+}
+
+func TestClientHandshake(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   func(w io.Writer)
+		version uint32
+		err     string
+	}{
+		{name: "agreed", reply: func(w io.Writer) { writeMessage(w, MsgHello, encodeUint32(MinProtocolVersion)) }, version: MinProtocolVersion},
+		{name: "version too new", reply: func(w io.Writer) { writeMessage(w, MsgHello, encodeUint32(ProtocolVersion+1)) }, err: "unsupported protocol version"},
+		{name: "version too old", reply: func(w io.Writer) { writeMessage(w, MsgHello, encodeUint32(MinProtocolVersion-1)) }, err: "unsupported protocol version"},
+		{name: "malformed version", reply: func(w io.Writer) { writeMessage(w, MsgHello, []byte{1}) }, err: "expected 4 byte payload"},
+		{name: "wrong message", reply: func(w io.Writer) { writeMessage(w, MsgSyncEnd, nil) }, err: "expected hello message"},
+		{name: "server error", reply: func(w io.Writer) { writeMessage(w, MsgError, []byte("go away")) }, err: "peer sent error: go away"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reply := &bytes.Buffer{}
+			test.reply(reply)
+			sent := &bytes.Buffer{}
+			version, err := clientHandshake(bufio.NewReadWriter(bufio.NewReader(reply), bufio.NewWriter(sent)))
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != test.version {
+				t.Fatalf("expected version %d got %d", test.version, version)
+			}
+			if payload, err := expectMessage(sent, MsgHello); err != nil || !bytes.Equal(payload, encodeUint32(ProtocolVersion)) {
+				t.Fatalf("expected client to send its version: %v", err)
+			}
+		})
+	}
+}
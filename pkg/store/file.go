@@ -0,0 +1,267 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/warmans/catbux/pkg/blocks"
+)
+
+const (
+	logFileName   = "blocks.log"
+	indexFileName = "blocks.idx"
+
+	// each record in the log is prefixed with the payload length and a CRC32 of the payload.
+	recordHeaderSize = 8
+	// each index entry is the offset of the block's record in the log.
+	indexEntrySize = 8
+	// records larger than this are assumed to be corrupt.
+	maxRecordSize = 64 << 20
+)
+
+// errTruncatedRecord is returned by readRecord when the log ends part way through a record.
+var errTruncatedRecord = errors.New("record was truncated")
+
+// NewFileStore opens (or creates) a block store in the given directory. Blocks are kept in an append-only log of
+// checksummed JSON records with a separate index of record offsets. The index is rebuilt from the log if it is missing
+// or stale.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	logFile, err := os.OpenFile(path.Join(dir, logFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	indexFile, err := os.OpenFile(path.Join(dir, indexFileName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		logFile.Close()
+		return nil, err
+	}
+	return &FileStore{log: logFile, index: indexFile}, nil
+}
+
+type FileStore struct {
+	mu      sync.Mutex
+	log     *os.File
+	index   *os.File
+	offsets []int64
+	size    int64
+}
+
+// Load reads all blocks from the log. A trailing record that was only partially written (e.g. because the node
+// crashed) is discarded. Any other corrupt record is an error as discarding it would also discard every block after
+// it. The index is rebuilt if it does not match the log.
+func (s *FileStore) Load() ([]*blocks.Block, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stat, err := s.log.Stat()
+	if err != nil {
+		return nil, err
+	}
+	indexed, err := s.readIndex()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read index")
+	}
+	// the index entry for a record is only written once the record is synced so a record before the last indexed one
+	// was completely written. Entries past the end of the log are left over from an interrupted Truncate.
+	lastIndexed := int64(-1)
+	for _, offset := range indexed {
+		if offset < stat.Size() && offset > lastIndexed {
+			lastIndexed = offset
+		}
+	}
+
+	if _, err := s.log.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(s.log)
+
+	result := []*blocks.Block{}
+	offsets := []int64{}
+	offset := int64(0)
+	for {
+		block, size, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			partial := errors.Cause(err) == errTruncatedRecord || offset+size >= stat.Size()
+			if !partial || offset < lastIndexed {
+				return nil, errors.Wrapf(err, "block log was corrupt at offset %d", offset)
+			}
+			log.Printf("discarding truncated block record at offset %d: %s", offset, err.Error())
+			if err := s.log.Truncate(offset); err != nil {
+				return nil, errors.Wrap(err, "failed to truncate block log")
+			}
+			break
+		}
+		result = append(result, block)
+		offsets = append(offsets, offset)
+		offset += size
+	}
+	s.offsets = offsets
+	s.size = offset
+
+	if !equalOffsets(indexed, offsets) {
+		log.Printf("block index did not match block log, rebuilding")
+		if err := s.writeIndex(); err != nil {
+			return nil, errors.Wrap(err, "failed to rebuild index")
+		}
+	}
+	return result, nil
+}
+
+func (s *FileStore) Append(block *blocks.Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	payload, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[recordHeaderSize:], payload)
+
+	if _, err := s.log.WriteAt(record, s.size); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+
+	entry := make([]byte, indexEntrySize)
+	binary.BigEndian.PutUint64(entry, uint64(s.size))
+	if _, err := s.index.WriteAt(entry, int64(len(s.offsets))*indexEntrySize); err != nil {
+		return err
+	}
+	s.offsets = append(s.offsets, s.size)
+	s.size += int64(len(record))
+	return nil
+}
+
+func (s *FileStore) Truncate(index int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if index < 0 || index > int64(len(s.offsets)) {
+		return fmt.Errorf("cannot truncate to index %d: store contains %d blocks", index, len(s.offsets))
+	}
+	if index == int64(len(s.offsets)) {
+		return nil
+	}
+	offset := s.offsets[index]
+	if err := s.log.Truncate(offset); err != nil {
+		return err
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	if err := s.index.Truncate(index * indexEntrySize); err != nil {
+		return err
+	}
+	s.offsets = s.offsets[:index]
+	s.size = offset
+	return nil
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	indexErr := s.index.Close()
+	if err := s.log.Close(); err != nil {
+		return err
+	}
+	return indexErr
+}
+
+// readIndex returns the record offsets in the index. A partially written trailing entry is ignored.
+func (s *FileStore) readIndex() ([]int64, error) {
+	stat, err := s.index.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, stat.Size()-stat.Size()%indexEntrySize)
+	if _, err := s.index.ReadAt(data, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+	offsets := make([]int64, len(data)/indexEntrySize)
+	for k := range offsets {
+		offsets[k] = int64(binary.BigEndian.Uint64(data[k*indexEntrySize:]))
+	}
+	return offsets, nil
+}
+
+// writeIndex replaces the index with the offsets found in the log.
+func (s *FileStore) writeIndex() error {
+	data := make([]byte, len(s.offsets)*indexEntrySize)
+	for k, offset := range s.offsets {
+		binary.BigEndian.PutUint64(data[k*indexEntrySize:], uint64(offset))
+	}
+	if err := s.index.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.index.WriteAt(data, 0); err != nil {
+		return err
+	}
+	return s.index.Sync()
+}
+
+func equalOffsets(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if a[k] != b[k] {
+			return false
+		}
+	}
+	return true
+}
+
+func readRecord(r io.Reader) (*blocks.Block, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	if n, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF && n == 0 {
+			return nil, 0, io.EOF
+		}
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, errors.Wrap(errTruncatedRecord, "incomplete record header")
+		}
+		return nil, 0, err
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	// the size of invalid records is returned so the caller can tell if the record runs to the end of the log
+	recordSize := int64(size) + recordHeaderSize
+	if size > maxRecordSize {
+		return nil, recordSize, fmt.Errorf("record size %d exceeds maximum", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, 0, errors.Wrap(errTruncatedRecord, "incomplete record payload")
+		}
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, recordSize, fmt.Errorf("record checksum mismatch")
+	}
+	block := &blocks.Block{}
+	if err := json.Unmarshal(payload, block); err != nil {
+		return nil, recordSize, errors.Wrap(err, "failed to decode block")
+	}
+	return block, recordSize, nil
+}
@@ -0,0 +1,218 @@
+package store
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/warmans/catbux/pkg/blocks"
+)
+
+func testStore(t *testing.T) (*FileStore, string) {
+	dir, err := ioutil.TempDir("", "catbux-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return openStore(t, dir), dir
+}
+
+func openStore(t *testing.T, dir string) *FileStore {
+	s, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatalf("failed to open store: %s", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func testBlocks(n int) []*blocks.Block {
+	result := make([]*blocks.Block, n)
+	for k := range result {
+		result[k] = &blocks.Block{BlockHeader: blocks.BlockHeader{Index: int64(k)}, Hash: fmt.Sprintf("block-%d", k)}
+	}
+	return result
+}
+
+func loadHashes(t *testing.T, s *FileStore) []string {
+	loaded, err := s.Load()
+	if err != nil {
+		t.Fatalf("failed to load: %s", err)
+	}
+	hashes := make([]string, len(loaded))
+	for k, b := range loaded {
+		hashes[k] = b.Hash
+	}
+	return hashes
+}
+
+func TestFileStoreRecoversFromTruncatedRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(data []byte, lastRecord int) []byte
+	}{
+		{name: "partial header", corrupt: func(data []byte, lastRecord int) []byte { return data[:lastRecord+recordHeaderSize-3] }},
+		{name: "partial payload", corrupt: func(data []byte, lastRecord int) []byte { return data[:len(data)-5] }},
+		{name: "checksum mismatch", corrupt: func(data []byte, lastRecord int) []byte {
+			data[len(data)-2] ^= 1
+			return data
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, dir := testStore(t)
+			stored := testBlocks(3)
+			for _, b := range stored {
+				if err := s.Append(b); err != nil {
+					t.Fatalf("failed to append: %s", err)
+				}
+			}
+			lastRecord := s.offsets[2]
+			s.Close()
+
+			logPath := path.Join(dir, logFileName)
+			data, err := ioutil.ReadFile(logPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(logPath, test.corrupt(data, int(lastRecord)), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			s = openStore(t, dir)
+			if got, expected := loadHashes(t, s), []string{"block-0", "block-1"}; !reflect.DeepEqual(got, expected) {
+				t.Fatalf("expected %v got %v", expected, got)
+			}
+			stat, err := os.Stat(logPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stat.Size() != lastRecord {
+				t.Fatalf("expected log to be truncated to %d bytes got %d", lastRecord, stat.Size())
+			}
+
+			// the store can be appended to after recovery
+			if err := s.Append(stored[2]); err != nil {
+				t.Fatalf("failed to append: %s", err)
+			}
+			s.Close()
+			if got, expected := loadHashes(t, openStore(t, dir)), []string{"block-0", "block-1", "block-2"}; !reflect.DeepEqual(got, expected) {
+				t.Fatalf("expected %v got %v", expected, got)
+			}
+		})
+	}
+}
+
+func TestFileStoreTruncate(t *testing.T) {
+	s, dir := testStore(t)
+	for _, b := range testBlocks(4) {
+		if err := s.Append(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Truncate(5); err == nil {
+		t.Fatal("expected truncating past the end to fail")
+	}
+	if err := s.Truncate(2); err != nil {
+		t.Fatalf("failed to truncate: %s", err)
+	}
+	if err := s.Append(testBlocks(4)[3]); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	if got, expected := loadHashes(t, openStore(t, dir)), []string{"block-0", "block-1", "block-3"}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("expected %v got %v", expected, got)
+	}
+}
+
+func appendTestBlocks(t *testing.T, s *FileStore, n int) {
+	for _, b := range testBlocks(n) {
+		if err := s.Append(b); err != nil {
+			t.Fatalf("failed to append: %s", err)
+		}
+	}
+}
+
+func TestFileStoreRejectsCorruptRecordBeforeTail(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(data []byte, offsets []int64)
+	}{
+		{name: "checksum mismatch", corrupt: func(data []byte, offsets []int64) { data[offsets[1]+recordHeaderSize] ^= 1 }},
+		{name: "oversized record", corrupt: func(data []byte, offsets []int64) { data[offsets[1]] = 0xff }},
+		{name: "record runs past end of log", corrupt: func(data []byte, offsets []int64) { data[offsets[1]+1] = 0xff }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, dir := testStore(t)
+			appendTestBlocks(t, s, 3)
+			offsets := append([]int64{}, s.offsets...)
+			s.Close()
+
+			logPath := path.Join(dir, logFileName)
+			data, err := ioutil.ReadFile(logPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.corrupt(data, offsets)
+			if err := ioutil.WriteFile(logPath, data, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := openStore(t, dir).Load(); err == nil || !strings.Contains(err.Error(), "corrupt at offset") {
+				t.Fatalf("expected corrupt record to fail the load got %v", err)
+			}
+			if stat, err := os.Stat(logPath); err != nil || stat.Size() != int64(len(data)) {
+				t.Fatal("expected the log to be left as it was")
+			}
+		})
+	}
+}
+
+func TestFileStoreRebuildsIndex(t *testing.T) {
+	tests := []struct {
+		name  string
+		index func(indexPath string) error
+	}{
+		{name: "missing", index: os.Remove},
+		{name: "stale", index: func(indexPath string) error { return ioutil.WriteFile(indexPath, make([]byte, indexEntrySize*5), 0600) }},
+		{name: "partial entry", index: func(indexPath string) error { return os.Truncate(indexPath, indexEntrySize*2+3) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, dir := testStore(t)
+			appendTestBlocks(t, s, 3)
+			s.Close()
+
+			indexPath := path.Join(dir, indexFileName)
+			expected, err := ioutil.ReadFile(indexPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := test.index(indexPath); err != nil {
+				t.Fatal(err)
+			}
+
+			s = openStore(t, dir)
+			if got := loadHashes(t, s); len(got) != 3 {
+				t.Fatalf("expected 3 blocks got %v", got)
+			}
+			if got, err := ioutil.ReadFile(indexPath); err != nil || string(got) != string(expected) {
+				t.Fatalf("expected index to be rebuilt: %v", err)
+			}
+			// the rebuilt index is used to truncate
+			if err := s.Truncate(1); err != nil {
+				t.Fatal(err)
+			}
+			s.Close()
+			if got, expected := loadHashes(t, openStore(t, dir)), []string{"block-0"}; !reflect.DeepEqual(got, expected) {
+				t.Fatalf("expected %v got %v", expected, got)
+			}
+		})
+	}
+}
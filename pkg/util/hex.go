@@ -1,6 +1,9 @@
 package util
 
-import "fmt"
+import (
+	"fmt"
+	"math/bits"
+)
 
 func HexToBin(s string) string {
 	res := ""
@@ -9,3 +12,15 @@ func HexToBin(s string) string {
 	}
 	return res
 }
+
+// LeadingZeroBits counts the zero bits at the start of b.
+func LeadingZeroBits(b []byte) int {
+	zeros := 0
+	for _, c := range b {
+		if c != 0 {
+			return zeros + bits.LeadingZeros8(c)
+		}
+		zeros += 8
+	}
+	return zeros
+}
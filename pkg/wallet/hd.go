@@ -0,0 +1,99 @@
+package wallet
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/tyler-smith/go-bip39"
+	"github.com/warmans/catbux/pkg/crypto"
+)
+
+const (
+	// DefaultDerivationPath is the path of the key that HD wallet keys are derived from. The wallet's keys are its
+	// non-hardened children so the nth key is at DefaultDerivationPath/n.
+	DefaultDerivationPath = "m/44'/0'/0'/0"
+	// DefaultGapLimit is the number of unused keys in a row after which scanning stops.
+	DefaultGapLimit = 20
+
+	mnemonicEntropyBits = 128
+)
+
+// NewMnemonic creates a random 12 word BIP39 mnemonic from which an HD wallet can be restored.
+func NewMnemonic() (string, error) {
+	entropy, err := bip39.NewEntropy(mnemonicEntropyBits)
+	if err != nil {
+		return "", err
+	}
+	return bip39.NewMnemonic(entropy)
+}
+
+// HDWallet derives any number of wallets from a single seed so they can all be restored from its mnemonic.
+type HDWallet struct {
+	account *crypto.ExtendedKey
+}
+
+// FromMnemonic creates the HD wallet for the mnemonic and (optional) passphrase using DefaultDerivationPath.
+func FromMnemonic(mnemonic string, passphrase string) (*HDWallet, error) {
+	mnemonic = strings.Join(strings.Fields(mnemonic), " ")
+	// IsMnemonicValid only checks the words so the checksum is verified by decoding the entropy
+	if _, err := bip39.EntropyFromMnemonic(mnemonic); err != nil {
+		return nil, fmt.Errorf("invalid mnemonic (check the words and their order)")
+	}
+	return FromSeed(bip39.NewSeed(mnemonic, passphrase), DefaultDerivationPath)
+}
+
+// FromSeed creates the HD wallet whose keys are the children of the key at the given path.
+func FromSeed(seed []byte, derivationPath string) (*HDWallet, error) {
+	path, err := crypto.ParseDerivationPath(derivationPath)
+	if err != nil {
+		return nil, err
+	}
+	master, err := crypto.NewMasterKey(seed)
+	if err != nil {
+		return nil, err
+	}
+	account, err := master.Derive(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to derive account key")
+	}
+	return &HDWallet{account: account}, nil
+}
+
+// Wallet returns the wallet with the nth derived key.
+func (h *HDWallet) Wallet(n uint32) (*Wallet, error) {
+	if n >= crypto.HardenedKeyStart {
+		return nil, fmt.Errorf("wallet index %d was out of range", n)
+	}
+	child, err := h.account.Child(n)
+	if err != nil {
+		return nil, err
+	}
+	return New(child.Key)
+}
+
+// Scan derives wallets in order until gapLimit wallets in a row have not been used and returns the used ones. The
+// used func reports whether any of a wallet's addresses have been paid. The index of the first wallet after the
+// last used one (i.e. the next wallet to hand out) is also returned.
+func (h *HDWallet) Scan(gapLimit int, used func(w *Wallet) (bool, error)) ([]*Wallet, uint32, error) {
+	if gapLimit < 1 {
+		return nil, 0, fmt.Errorf("gap limit must be at least 1")
+	}
+	found := []*Wallet{}
+	next := uint32(0)
+	for n := uint32(0); n < next+uint32(gapLimit); n++ {
+		w, err := h.Wallet(n)
+		if err != nil {
+			return nil, 0, err
+		}
+		isUsed, err := used(w)
+		if err != nil {
+			return nil, 0, err
+		}
+		if isUsed {
+			found = append(found, w)
+			next = n + 1
+		}
+	}
+	return found, next, nil
+}
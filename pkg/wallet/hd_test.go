@@ -0,0 +1,116 @@
+package wallet
+
+import (
+	"testing"
+)
+
+const testMnemonic = "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+
+func testHDWallet(t *testing.T) *HDWallet {
+	h, err := FromMnemonic(testMnemonic, "")
+	if err != nil {
+		t.Fatalf("failed to create HD wallet: %s", err)
+	}
+	return h
+}
+
+func TestHDWalletScan(t *testing.T) {
+	h := testHDWallet(t)
+
+	used := map[uint32]bool{0: true, 3: true, 22: true}
+	usedAddresses := map[string]uint32{}
+	for n := range used {
+		w, err := h.Wallet(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		usedAddresses[w.Address()] = n
+	}
+
+	tests := []struct {
+		name     string
+		gapLimit int
+		expected []uint32
+		next     uint32
+		scanned  uint32
+	}{
+		{name: "gap covers all used", gapLimit: 20, expected: []uint32{0, 3, 22}, next: 23, scanned: 43},
+		{name: "gap stops before last used", gapLimit: 5, expected: []uint32{0, 3}, next: 4, scanned: 9},
+		{name: "gap of one", gapLimit: 1, expected: []uint32{0}, next: 1, scanned: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			scanned := uint32(0)
+			found, next, err := h.Scan(test.gapLimit, func(w *Wallet) (bool, error) {
+				scanned++
+				_, ok := usedAddresses[w.Address()]
+				return ok, nil
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if next != test.next {
+				t.Errorf("expected next %d got %d", test.next, next)
+			}
+			if scanned != test.scanned {
+				t.Errorf("expected %d wallets to be checked got %d", test.scanned, scanned)
+			}
+			if len(found) != len(test.expected) {
+				t.Fatalf("expected %d used wallets got %d", len(test.expected), len(found))
+			}
+			for k, w := range found {
+				if n := usedAddresses[w.Address()]; n != test.expected[k] {
+					t.Errorf("expected wallet %d to be index %d got %d", k, test.expected[k], n)
+				}
+			}
+		})
+	}
+}
+
+func TestHDWalletScanRejectsZeroGapLimit(t *testing.T) {
+	h := testHDWallet(t)
+	if _, _, err := h.Scan(0, func(w *Wallet) (bool, error) { return false, nil }); err == nil {
+		t.Fatal("expected gap limit of 0 to be rejected")
+	}
+}
+
+func TestFromMnemonicIsDeterministic(t *testing.T) {
+	a := testHDWallet(t)
+	b, err := FromMnemonic("  abandon abandon abandon abandon abandon abandon\nabandon abandon abandon abandon abandon about ", "")
+	if err != nil {
+		t.Fatalf("failed to create HD wallet: %s", err)
+	}
+	withPassphrase, err := FromMnemonic(testMnemonic, "secret")
+	if err != nil {
+		t.Fatalf("failed to create HD wallet: %s", err)
+	}
+
+	for n := uint32(0); n < 3; n++ {
+		wa, _ := a.Wallet(n)
+		wb, _ := b.Wallet(n)
+		wp, _ := withPassphrase.Wallet(n)
+		if wa.Address() != wb.Address() {
+			t.Errorf("wallet %d differed after normalising whitespace", n)
+		}
+		if wa.Address() == wp.Address() {
+			t.Errorf("wallet %d was the same with a passphrase", n)
+		}
+	}
+	w0, _ := a.Wallet(0)
+	w1, _ := a.Wallet(1)
+	if w0.Address() == w1.Address() {
+		t.Fatal("wallets 0 and 1 had the same address")
+	}
+}
+
+func TestFromMnemonicRejectsInvalid(t *testing.T) {
+	for _, mnemonic := range []string{
+		"",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon",
+		"abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandonx",
+	} {
+		if _, err := FromMnemonic(mnemonic, ""); err == nil {
+			t.Errorf("expected mnemonic %q to be rejected", mnemonic)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package wallet
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/pkg/errors"
+	"github.com/warmans/catbux/pkg/blocks"
+	"github.com/warmans/catbux/pkg/crypto"
+)
+
+// MultiSigLock creates the lock of an m of n multisig account. The keys are sorted so every co-signer derives the
+// same lock (and so the same address) whatever order they list the keys in. Funds are paid to the account by paying
+// to the lock's text.
+func MultiSigLock(m int, keys ...string) (blocks.Lock, error) {
+	sorted := append([]string{}, keys...)
+	sort.Strings(sorted)
+	return blocks.ParseLock(blocks.MultiSigLock(m, sorted...).String())
+}
+
+// PartialTransaction is a transaction spending locked txn outs that is passed between co-signers until it has enough
+// signatures to satisfy the locks. Spent holds the txn out spent by each txn in so that co-signers can check and sign
+// it without asking a node.
+type PartialTransaction struct {
+	Transaction *blocks.Transaction     `json:"transaction"`
+	Spent       []*blocks.TxnOutUnspent `json:"spent"`
+}
+
+// CreatePartialTransaction builds an unsigned transaction paying amount from the txn outs locked by lock to the
+// given address (or lock) and fee to the miner. Any remainder is paid back to the lock.
+func CreatePartialTransaction(lock blocks.Lock, to string, amount int64, fee int64, lockTime int64, unspent *blocks.TxnOutUnspentSet, pending []*blocks.Transaction) (*PartialTransaction, error) {
+	from := &blocks.TxnOut{Address: blocks.LockAddress(lock), Lock: lock.String()}
+	txn, spent, err := buildTransaction(from, []string{from.Address}, to, amount, fee, lockTime, unspent, pending)
+	if err != nil {
+		return nil, err
+	}
+	return &PartialTransaction{Transaction: txn, Spent: spent}, nil
+}
+
+// LoadPartialTransaction reads a partial transaction file.
+func LoadPartialTransaction(filePath string) (*PartialTransaction, error) {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	p := &PartialTransaction{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode partial transaction in %s", filePath)
+	}
+	if _, err := p.unspent(); err != nil {
+		return nil, errors.Wrapf(err, "invalid partial transaction in %s", filePath)
+	}
+	return p, nil
+}
+
+// Save writes the partial transaction to the given path, replacing any existing file.
+func (p *PartialTransaction) Save(filePath string) error {
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filePath, append(data, '\n'), 0600)
+}
+
+// Complete returns the transaction if it has enough signatures to spend every txn out.
+func (p *PartialTransaction) Complete() (*blocks.Transaction, error) {
+	unspent, err := p.unspent()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Transaction.Validate(unspent); err != nil {
+		return nil, errors.Wrap(err, "transaction is not complete")
+	}
+	return p.Transaction, nil
+}
+
+// unspent is a set of the spent txn outs which must match the transaction's txn ins.
+func (p *PartialTransaction) unspent() (*blocks.TxnOutUnspentSet, error) {
+	if p.Transaction == nil {
+		return nil, fmt.Errorf("transaction was missing")
+	}
+	if p.Transaction.ID != blocks.GetTransactionID(p.Transaction) {
+		return nil, fmt.Errorf("invalid transaction ID")
+	}
+	if int64(len(p.Spent)) != p.Transaction.TxnIn.Len() {
+		return nil, fmt.Errorf("expected %d spent txn outs but got %d", p.Transaction.TxnIn.Len(), len(p.Spent))
+	}
+	unspent := blocks.NewTxnOutUnspentSet()
+	for k, spent := range p.Spent {
+		in, err := p.Transaction.GetTxnIn(int64(k))
+		if err != nil {
+			return nil, err
+		}
+		if spent == nil || spent.TxnOutID != in.TxnOutID || spent.TxnOutIndex != in.TxnOutIndex {
+			return nil, fmt.Errorf("spent txn out %d did not match txn in", k)
+		}
+		unspent.Add(spent)
+	}
+	return unspent, nil
+}
+
+// SignPartialTransaction adds the wallet's signature to each txn in whose lock names the wallet's key and that it
+// has not already signed. It returns the number of signatures added.
+func (w *Wallet) SignPartialTransaction(p *PartialTransaction) (int, error) {
+	unspent, err := p.unspent()
+	if err != nil {
+		return 0, err
+	}
+	signed := 0
+	for k, spent := range p.Spent {
+		lock, err := blocks.ParseLock(spent.Lock)
+		if err != nil || !containsString(blocks.LockKeys(lock), w.pubKey) {
+			continue
+		}
+		in, err := p.Transaction.GetTxnIn(int64(k))
+		if err != nil {
+			return signed, err
+		}
+		if w.hasSigned(in.Witness, blocks.SignatureHash(p.Transaction, int64(k), spent)) {
+			continue
+		}
+		signature, err := blocks.SignTxnInLock(p.Transaction, int64(k), w.key, unspent)
+		if err != nil {
+			return signed, errors.Wrapf(err, "failed to sign txn in %d", k)
+		}
+		if in.Witness == nil {
+			in.Witness = &blocks.Witness{}
+		}
+		in.Witness.Signatures = append(in.Witness.Signatures, signature)
+		signed++
+	}
+	return signed, nil
+}
+
+func (w *Wallet) hasSigned(witness *blocks.Witness, sigHash []byte) bool {
+	if witness == nil {
+		return false
+	}
+	for _, sig := range witness.Signatures {
+		decoded, err := base64.URLEncoding.DecodeString(sig)
+		if err == nil && crypto.Verify(sigHash, decoded, &w.key.PublicKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// CombinePartialTransactions merges the signatures of copies of the same partial transaction signed by different
+// co-signers. The signatures are added to the first copy which is returned.
+func CombinePartialTransactions(parts ...*PartialTransaction) (*PartialTransaction, error) {
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("no partial transactions to combine")
+	}
+	combined := parts[0]
+	if _, err := combined.unspent(); err != nil {
+		return nil, err
+	}
+	for n, p := range parts[1:] {
+		if _, err := p.unspent(); err != nil {
+			return nil, errors.Wrapf(err, "partial transaction %d", n+1)
+		}
+		if p.Transaction.ID != combined.Transaction.ID {
+			return nil, fmt.Errorf("partial transaction %d is for a different transaction", n+1)
+		}
+		for k, spent := range p.Spent {
+			if *spent != *combined.Spent[k] {
+				return nil, fmt.Errorf("partial transaction %d spent txn out %d did not match", n+1, k)
+			}
+			from, _ := p.Transaction.GetTxnIn(int64(k))
+			to, _ := combined.Transaction.GetTxnIn(int64(k))
+			if from.Witness == nil {
+				continue
+			}
+			if to.Witness == nil {
+				to.Witness = &blocks.Witness{}
+			}
+			sigHash := blocks.SignatureHash(combined.Transaction, int64(k), spent)
+			to.Witness.Signatures = mergeSignatures(to.Witness.Signatures, from.Witness.Signatures, sigHash, spent.Lock)
+			to.Witness.Preimages = mergeStrings(to.Witness.Preimages, from.Witness.Preimages)
+		}
+	}
+	return combined, nil
+}
+
+// mergeSignatures adds signatures by keys of the lock that have not already signed. A co-signer that signed more than
+// one copy produces a different signature each time but only one is kept as witnesses may not hold more signatures
+// than the lock has keys.
+func mergeSignatures(to []string, from []string, sigHash []byte, lockText string) []string {
+	lock, err := blocks.ParseLock(lockText)
+	if err != nil {
+		return to
+	}
+	signer := func(sig string) string {
+		decoded, err := base64.URLEncoding.DecodeString(sig)
+		if err != nil {
+			return ""
+		}
+		for _, key := range blocks.LockKeys(lock) {
+			pub, err := crypto.PubKeyFromBase64(key)
+			if err == nil && crypto.Verify(sigHash, decoded, pub) {
+				return key
+			}
+		}
+		return ""
+	}
+	signed := map[string]struct{}{}
+	for _, sig := range to {
+		signed[signer(sig)] = struct{}{}
+	}
+	for _, sig := range from {
+		key := signer(sig)
+		if _, found := signed[key]; key == "" || found {
+			continue
+		}
+		signed[key] = struct{}{}
+		to = append(to, sig)
+	}
+	return to
+}
+
+func mergeStrings(to []string, from []string) []string {
+	for _, s := range from {
+		if !containsString(to, s) {
+			to = append(to, s)
+		}
+	}
+	return to
+}
+
+func containsString(keys []string, key string) bool {
+	for _, k := range keys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
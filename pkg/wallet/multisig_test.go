@@ -0,0 +1,83 @@
+package wallet
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/warmans/catbux/pkg/blocks"
+)
+
+func testWallets(t *testing.T, n int) []*Wallet {
+	wallets := make([]*Wallet, n)
+	for k := range wallets {
+		w, err := Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wallets[k] = w
+	}
+	return wallets
+}
+
+// copyPartialTransaction copies the partial transaction the same way co-signers receive it: as a file.
+func copyPartialTransaction(t *testing.T, p *PartialTransaction) *PartialTransaction {
+	data, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &PartialTransaction{}
+	if err := json.Unmarshal(data, c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func testPartialTransaction(t *testing.T, m int, wallets []*Wallet) *PartialTransaction {
+	keys := make([]string, len(wallets))
+	for k, w := range wallets {
+		keys[k] = w.PubKey()
+	}
+	lock, err := MultiSigLock(m, keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unspent := blocks.NewTxnOutUnspentSet()
+	unspent.Add(&blocks.TxnOutUnspent{TxnOutID: "funding", TxnOutIndex: 0, Address: blocks.LockAddress(lock), Amount: 100, Lock: lock.String()})
+
+	p, err := CreatePartialTransaction(lock, wallets[0].Address(), 60, 1, 0, unspent, nil)
+	if err != nil {
+		t.Fatalf("failed to create partial transaction: %s", err)
+	}
+	return p
+}
+
+func TestCombinePartialTransactions(t *testing.T) {
+	wallets := testWallets(t, 3)
+	p := testPartialTransaction(t, 2, wallets)
+
+	// the first co-signer signs two copies and the second signs one
+	first, again, second := copyPartialTransaction(t, p), copyPartialTransaction(t, p), copyPartialTransaction(t, p)
+	for _, signed := range []struct {
+		w *Wallet
+		p *PartialTransaction
+	}{{wallets[0], first}, {wallets[0], again}, {wallets[1], second}} {
+		if n, err := signed.w.SignPartialTransaction(signed.p); err != nil || n != 1 {
+			t.Fatalf("expected one signature to be added: %d %v", n, err)
+		}
+	}
+	if _, err := first.Complete(); err == nil {
+		t.Fatal("expected a single signature to be incomplete")
+	}
+
+	combined, err := CombinePartialTransactions(first, again, second)
+	if err != nil {
+		t.Fatalf("failed to combine: %s", err)
+	}
+	in, _ := combined.Transaction.GetTxnIn(0)
+	if got := len(in.Witness.Signatures); got != 2 {
+		t.Fatalf("expected one signature per co-signer got %d", got)
+	}
+	if _, err := combined.Complete(); err != nil {
+		t.Fatalf("expected combined transaction to be complete: %s", err)
+	}
+}
@@ -0,0 +1,228 @@
+package wallet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/warmans/catbux/pkg/blocks"
+	"github.com/warmans/catbux/pkg/crypto"
+)
+
+const DefaultKeyPath = ".ecdsa/id_ecdsa"
+
+// New creates a wallet for the given key. Only P-256 keys are accepted as outs locked to keys on other curves could
+// never be spent.
+func New(key *ecdsa.PrivateKey) (*Wallet, error) {
+	if key.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("wallet key must use the P-256 curve not %s", key.Params().Name)
+	}
+	pubKey, err := crypto.PubKeyToBase64(&key.PublicKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to derive address")
+	}
+	return &Wallet{key: key, address: crypto.PubKeyToAddress(&key.PublicKey), pubKey: pubKey}, nil
+}
+
+// Generate creates a wallet with a new random key.
+func Generate() (*Wallet, error) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	return New(key)
+}
+
+// Load reads the wallet key from a PEM file e.g. the one created by `make keys`.
+func Load(keyPath string) (*Wallet, error) {
+	data, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := crypto.DecodePrivateKey(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to decode key in %s", keyPath)
+	}
+	return New(key)
+}
+
+// LoadOrGenerate loads the wallet key from the given path or creates and saves a new one if the file does not exist.
+func LoadOrGenerate(keyPath string) (*Wallet, error) {
+	w, err := Load(keyPath)
+	if err == nil {
+		return w, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if w, err = Generate(); err != nil {
+		return nil, err
+	}
+	return w, w.Save(keyPath)
+}
+
+type Wallet struct {
+	key     *ecdsa.PrivateKey
+	address string
+	pubKey  string
+}
+
+// Save writes the wallet key to the given path. Existing files are not overwritten.
+func (w *Wallet) Save(keyPath string) error {
+	encoded, err := crypto.EncodePrivateKey(w.key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(keyPath), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(encoded); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Address is the wallet's short address. New txn outs (including change) are paid to it.
+func (w *Wallet) Address() string {
+	return w.address
+}
+
+// PubKey is the wallet's base64 encoded public key. It can also be used as an address (and was the only address
+// before short addresses) and is how the wallet is named in locks e.g. multisig accounts.
+func (w *Wallet) PubKey() string {
+	return w.pubKey
+}
+
+// Addresses are all the addresses the wallet can spend from.
+func (w *Wallet) Addresses() []string {
+	return []string{w.address, w.pubKey}
+}
+
+func (w *Wallet) Key() *ecdsa.PrivateKey {
+	return w.key
+}
+
+// Balance is the total of all unspent txn outs paid to the wallet's addresses.
+func (w *Wallet) Balance(unspent *blocks.TxnOutUnspentSet) int64 {
+	total := int64(0)
+	for _, address := range w.Addresses() {
+		for _, u := range unspent.ForAddress(address) {
+			total += u.Amount
+		}
+	}
+	return total
+}
+
+// CreateTransaction builds and signs a transaction paying amount to the given address (or lock) and fee to the miner.
+// Any remainder of the selected txn outs is paid back to the wallet. Txn outs already spent by pending transactions
+// (e.g. those in a pool) are not selected. A non-zero lockTime (block height or unix time) prevents the transaction
+// being mined before then.
+func (w *Wallet) CreateTransaction(to string, amount int64, fee int64, lockTime int64, unspent *blocks.TxnOutUnspentSet, pending []*blocks.Transaction) (*blocks.Transaction, error) {
+	txn, spent, err := buildTransaction(&blocks.TxnOut{Address: w.address}, w.Addresses(), to, amount, fee, lockTime, unspent, pending)
+	if err != nil {
+		return nil, err
+	}
+	for i := int64(0); i < txn.TxnIn.Len(); i++ {
+		in, err := txn.GetTxnIn(i)
+		if err != nil {
+			return nil, err
+		}
+		if in.Signature, err = blocks.SignTxnIn(txn, i, w.key, unspent); err != nil {
+			return nil, errors.Wrapf(err, "failed to sign txn in %d", i)
+		}
+		if spent[i].Address == w.address {
+			in.PubKey = hex.EncodeToString(crypto.CompressPubKey(&w.key.PublicKey))
+		}
+	}
+	return txn, nil
+}
+
+// buildTransaction builds an unsigned transaction spending txn outs paid to any of the addresses. Change is paid to
+// from. The spent txn outs are returned in the same order as the txn ins.
+func buildTransaction(from *blocks.TxnOut, addresses []string, to string, amount int64, fee int64, lockTime int64, unspent *blocks.TxnOutUnspentSet, pending []*blocks.Transaction) (*blocks.Transaction, []*blocks.TxnOutUnspent, error) {
+	if amount <= 0 {
+		return nil, nil, fmt.Errorf("amount must be greater than zero")
+	}
+	if fee < 0 {
+		return nil, nil, fmt.Errorf("fee must not be negative")
+	}
+	if lockTime < 0 {
+		return nil, nil, fmt.Errorf("lock time must not be negative")
+	}
+	out, err := newTxnOut(to, amount)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	selected, change, err := selectTxnOuts(addresses, amount+fee, unspent, pending)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	txn := &blocks.Transaction{Version: blocks.CurrentTxnVersion, LockTime: lockTime, TxnOut: []*blocks.TxnOut{out}}
+	if change > 0 {
+		txn.TxnOut = append(txn.TxnOut, &blocks.TxnOut{Address: from.Address, Amount: change, Lock: from.Lock})
+	}
+	for _, u := range selected {
+		txn.TxnIn.Append(&blocks.TxnIn{TxnOutID: u.TxnOutID, TxnOutIndex: u.TxnOutIndex})
+	}
+	txn.ID = blocks.GetTransactionID(txn)
+	return txn, selected, nil
+}
+
+// newTxnOut pays amount to the recipient which is either an address, a public key or the text of a lock (paid to its
+// LockAddress).
+func newTxnOut(to string, amount int64) (*blocks.TxnOut, error) {
+	if strings.Contains(to, "(") {
+		lock, err := blocks.ParseLock(to)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid recipient lock")
+		}
+		return &blocks.TxnOut{Address: blocks.LockAddress(lock), Amount: amount, Lock: to}, nil
+	}
+	if _, err := crypto.PubKeyFromBase64(to); err == nil {
+		return &blocks.TxnOut{Address: to, Amount: amount}, nil
+	}
+	if _, err := crypto.DecodeAddress(to); err != nil {
+		return nil, errors.Wrap(err, "invalid recipient address")
+	}
+	return &blocks.TxnOut{Address: to, Amount: amount}, nil
+}
+
+func selectTxnOuts(addresses []string, amount int64, unspent *blocks.TxnOutUnspentSet, pending []*blocks.Transaction) ([]*blocks.TxnOutUnspent, int64, error) {
+	spent := make(map[blocks.TxnOutRef]struct{})
+	for _, txn := range pending {
+		for _, ref := range txn.TxnIn.Spent() {
+			spent[ref] = struct{}{}
+		}
+	}
+
+	selected := []*blocks.TxnOutUnspent{}
+	total := int64(0)
+	available := []*blocks.TxnOutUnspent{}
+	for _, address := range addresses {
+		available = append(available, unspent.ForAddress(address)...)
+	}
+	for _, u := range available {
+		if _, found := spent[blocks.TxnOutRef{TxnOutID: u.TxnOutID, TxnOutIndex: u.TxnOutIndex}]; found {
+			continue
+		}
+		selected = append(selected, u)
+		total += u.Amount
+		if total >= amount {
+			return selected, total - amount, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("insufficient funds: required %d but only %d available", amount, total)
+}
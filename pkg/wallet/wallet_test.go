@@ -0,0 +1,72 @@
+package wallet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/warmans/catbux/pkg/crypto"
+)
+
+func TestNewRejectsCurvesOtherThanP256(t *testing.T) {
+	for _, curve := range []elliptic.Curve{elliptic.P224(), elliptic.P384(), elliptic.P521()} {
+		t.Run(curve.Params().Name, func(t *testing.T) {
+			key, err := ecdsa.GenerateKey(curve, rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := New(key); err == nil {
+				t.Fatal("expected key to be rejected")
+			}
+		})
+	}
+}
+
+func TestLoadRejectsCurvesOtherThanP256(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catbux-wallet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := crypto.EncodePrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := path.Join(dir, "id_ecdsa")
+	if err := ioutil.WriteFile(keyPath, encoded, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Load(keyPath); err == nil {
+		t.Fatal("expected P-384 key to be rejected")
+	}
+	// an unusable key is not replaced with a new one
+	if _, err := LoadOrGenerate(keyPath); err == nil {
+		t.Fatal("expected P-384 key to be rejected")
+	}
+
+	w, err := Generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256Path := path.Join(dir, "id_p256")
+	if err := w.Save(p256Path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(p256Path)
+	if err != nil {
+		t.Fatalf("failed to load P-256 key: %s", err)
+	}
+	if loaded.Address() != w.Address() {
+		t.Fatal("loaded wallet had a different address")
+	}
+}